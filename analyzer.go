@@ -5,6 +5,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -13,15 +16,121 @@ import (
 	lookout "gopkg.in/src-d/lookout-sdk.v0/pb"
 )
 
+// Config of the analyzer.
+type Config struct {
+	// Archs are the target architectures structs are analyzed for. If empty,
+	// DefaultArchs are used.
+	Archs []string
+	// PtrData makes the analyzer also suggest layouts that reduce the
+	// prefix of the struct the garbage collector has to scan.
+	PtrData bool
+	// SizeClassOnly makes the analyzer only suggest layouts that reduce the
+	// memory actually allocated for the struct, that is, when the new size
+	// falls in a smaller size class of the Go allocator.
+	SizeClassOnly bool
+	// Hot are the fields that must be packed in the first cache lines of
+	// their struct, in the form `Struct.Field`.
+	Hot []string
+	// Builds are the build configurations packages are loaded for. Every
+	// variant of a struct is analyzed separately. If empty, packages are
+	// loaded for the host.
+	Builds []Build
+	// ReportDir is the directory the reports of the audits of the
+	// repositories on pushes to their default branch are written to. If
+	// empty, no reports are written.
+	ReportDir string
+	// MinBytes is the minimum number of bytes a suggested layout must
+	// save.
+	MinBytes int64
+	// MinPercent is the minimum percentage of the size of a struct a
+	// suggested layout must save.
+	MinPercent float64
+	// Include are the glob patterns of the paths of the files that are
+	// analyzed. A pattern matching a directory matches all the files in
+	// it. If empty, all files are analyzed.
+	Include []string
+	// Exclude are the glob patterns of the paths of the files that are
+	// not analyzed.
+	Exclude []string
+	// IgnoreStructs are the glob patterns of the names of the structs
+	// that are not analyzed.
+	IgnoreStructs []string
+	// CommentStyle is the style of the comments with suggested layouts,
+	// CommentStyleFull or CommentStyleCompact. If empty, it is full.
+	CommentStyle string
+	// overrides are the configs of specific paths of the repository.
+	overrides []override
+}
+
+// hot returns the names of the hot fields of the struct with the given
+// name.
+func (c Config) hot(name string) []string {
+	var result []string
+	for _, h := range c.Hot {
+		parts := strings.SplitN(h, ".", 2)
+		if len(parts) == 2 && parts[0] == name {
+			result = append(result, parts[1])
+		}
+	}
+	return result
+}
+
+// improves reports whether the optimized layout of a struct is worth
+// suggesting according to the config. The minimum savings and the size
+// class filter apply to every improvement, including the ones in the
+// pointer-scan prefix and the hot fields.
+func (c Config) improves(before, after Struct) bool {
+	if !c.worthSaving(before.Size(), before.Size()-after.Size()) {
+		return false
+	}
+
+	if c.SizeClassOnly && after.SizeClass() >= before.SizeClass() {
+		return false
+	}
+
+	if c.PtrData && after.PtrData() < before.PtrData() {
+		return true
+	}
+
+	if after.hotLines(CacheLineSize) < before.hotLines(CacheLineSize) {
+		return true
+	}
+
+	return after.Padding() < before.Padding()
+}
+
+func (c Config) archs() []string {
+	if len(c.Archs) == 0 {
+		return DefaultArchs
+	}
+	return c.Archs
+}
+
 // Analyzer of memory layout.
 type Analyzer struct {
 	version    string
 	dataServer string
+	config     Config
+	cache      *CloneCache
+	// session keeps the packages loaded for previous reviews, so the ones
+	// that did not change are not type-checked again.
+	session *Session
 }
 
-// NewAnalyzer creates a new memlayout analyzer.
-func NewAnalyzer(version, dataServer string) *Analyzer {
-	return &Analyzer{version: version, dataServer: dataServer}
+// maxSessionPackages is the maximum number of packages kept loaded by the
+// analyzer between reviews.
+const maxSessionPackages = 256
+
+// NewAnalyzer creates a new memlayout analyzer. Repositories that have to
+// be checked out are cloned in the given cache.
+func NewAnalyzer(version, dataServer string, config Config, cache *CloneCache) *Analyzer {
+	return &Analyzer{
+		version:    version,
+		dataServer: dataServer,
+		config:     config,
+		cache:      cache,
+		session:    NewSession(maxSessionPackages),
+	}
 }
 
 // NotifyReviewEvent implements the lookout analyzer interface.
@@ -46,12 +155,7 @@ func (a *Analyzer) NotifyReviewEvent(ctx context.Context, review *lookout.Review
 		return nil, fmt.Errorf("error getting changes from data server %s", a.dataServer)
 	}
 
-	repoPath, err := clone(review)
-	if err != nil {
-		return nil, fmt.Errorf("unable to clone repo: %s", err)
-	}
-
-	var comments []*lookout.Comment
+	var all []*lookout.Change
 	for {
 		change, err := changes.Recv()
 		if err == io.EOF {
@@ -61,36 +165,486 @@ func (a *Analyzer) NotifyReviewEvent(ctx context.Context, review *lookout.Review
 			return nil, fmt.Errorf("could not receive changes from data server %s", a.dataServer)
 		}
 
-		comments = append(comments, commentsForChanges(repoPath, change)...)
+		all = append(all, change)
+	}
+
+	repoPath, files, cleanup, err := sources(ctx, dataClient, a.cache, review, all)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if files == nil {
+		defer a.session.forget(repoPath)
+	}
+
+	config, err := ConfigFor(a.config, review.Configuration, configFile(repoPath, files))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the packages imported by the changed ones are fetched, so the
+	// ones importing them have to be fetched too to find the structs
+	// impacted by the changes.
+	var importers func(dirs []string) (map[string][]byte, error)
+	if files != nil {
+		importers = func(dirs []string) (map[string][]byte, error) {
+			var fetched = make(map[string][]byte, len(files))
+			for name, content := range files {
+				rel, err := filepath.Rel(repoPath, name)
+				if err != nil {
+					return nil, err
+				}
+				fetched[filepath.ToSlash(rel)] = content
+			}
+
+			got, err := fetchImporters(ctx, dataClient, &review.Head, fetched, dirs)
+			if err != nil {
+				return nil, err
+			}
+			return overlayIn(repoPath, got), nil
+		}
 	}
 
 	return &lookout.EventResponse{
 		AnalyzerVersion: a.version,
-		Comments:        comments,
+		Comments:        commentsForReview(a.session, repoPath, files, importers, all, config),
 	}, nil
 }
 
-// NotifyPushEvent implements the lookout analyzer interface.
-func (*Analyzer) NotifyPushEvent(context.Context, *lookout.PushEvent) (*lookout.EventResponse, error) {
-	return &lookout.EventResponse{}, nil
+// sources returns the directory the head revision of a review is analyzed
+// in, and the files of the revision by absolute path, if they are not on
+// disk. The files of the packages of the changes, and of the ones they
+// import, are fetched from the data server, and the directory is the same
+// for every review of the repository, so the packages loaded for previous
+// reviews can be reused. Repositories that are not Go modules are checked
+// out from the given cache instead. The returned function removes the
+// checkout.
+func sources(ctx context.Context, client lookout.DataClient, cache *CloneCache, review *lookout.ReviewEvent, changes []*lookout.Change) (string, map[string][]byte, func(), error) {
+	var dirs []string
+	for _, change := range changes {
+		if change.Head != nil {
+			dirs = append(dirs, path.Dir(change.Head.Path))
+		}
+		if change.Base != nil {
+			dirs = append(dirs, path.Dir(change.Base.Path))
+		}
+	}
+
+	files, err := fetchFiles(ctx, client, &review.Head, dirs)
+	if err == errNoModule {
+		log.Debugf("repository is not a Go module, checking it out")
+		repoPath, cleanup, err := cache.Checkout(review.Head.InternalRepositoryURL, review.Head.Hash, review.Head.ReferenceName)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("unable to clone repo: %s", err)
+		}
+		return repoPath, nil, cleanup, nil
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	// The go command has to run in a directory on disk, even if all the
+	// files are in the overlay, so it is always empty.
+	root := filepath.Join(os.TempDir(), "memlayout-"+repoHash(review.Head.InternalRepositoryURL))
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return "", nil, nil, err
+	}
+
+	return root, overlayIn(root, files), func() {}, nil
 }
 
-func commentsForChanges(repoPath string, change *lookout.Change) []*lookout.Comment {
-	if change.Head == nil {
+// overlayIn returns an overlay with the given files, by path relative to
+// the given directory, by absolute path.
+func overlayIn(dir string, files map[string][]byte) map[string][]byte {
+	var overlay = make(map[string][]byte, len(files))
+	for name, content := range files {
+		overlay[filepath.Join(dir, filepath.FromSlash(name))] = content
+	}
+	return overlay
+}
+
+// configFile returns the content of the ConfigFile of the repository in the
+// given directory, or nil if it has none.
+func configFile(repoPath string, overlay map[string][]byte) []byte {
+	path := filepath.Join(repoPath, ConfigFile)
+	if content, ok := overlay[path]; ok {
+		return content
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return content
+}
+
+// maxAuditComments is the number of structs wasting the most memory that
+// are commented on in the audit of a repository.
+const maxAuditComments = 10
+
+// NotifyPushEvent implements the lookout analyzer interface. Pushes to the
+// default branch of a repository trigger an audit of all its packages,
+// which comments on the structs wasting the most memory and writes a
+// report with all of them.
+func (a *Analyzer) NotifyPushEvent(ctx context.Context, push *lookout.PushEvent) (*lookout.EventResponse, error) {
+	log.Infof("got push request %v", push)
+
+	// The default branch is known from the clone, so other branches are
+	// never checked out.
+	isDefault, err := a.cache.IsDefault(push.Head.InternalRepositoryURL, push.Head.Hash, push.Head.ReferenceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to clone repo: %s", err)
+	}
+
+	if !isDefault {
+		log.Debugf("skipping audit of push to %s, which is not the default branch", push.Head.ReferenceName)
+		return &lookout.EventResponse{AnalyzerVersion: a.version}, nil
+	}
+
+	repoPath, cleanup, err := a.cache.Checkout(push.Head.InternalRepositoryURL, push.Head.Hash, push.Head.ReferenceName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to clone repo: %s", err)
+	}
+	defer cleanup()
+	defer a.session.forget(repoPath)
+
+	config, err := ConfigFor(a.config, push.Configuration, configFile(repoPath, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	build := Build{}
+	if len(config.Builds) > 0 {
+		build = config.Builds[0]
+	}
+	arch := config.archs()[0]
+
+	all, errs, err := a.session.Audit(repoPath, build, arch)
+	if err != nil {
+		return nil, fmt.Errorf("unable to audit repo: %s", err)
+	}
+	for _, err := range errs {
+		log.Debugf("package skipped in the audit: %s", err)
+	}
+
+	var waste []Waste
+	for _, w := range all {
+		path, err := filepath.Rel(repoPath, w.File)
+		if err != nil {
+			continue
+		}
+
+		c := config.forPath(path)
+		if c.analyzes(path) && !c.ignores(w.Struct) && c.worthSaving(w.Struct.Size(), w.Wasted()) {
+			waste = append(waste, w)
+		}
+	}
+
+	report := NewReport(push.Head.InternalRepositoryURL, push.Head.Hash, repoPath, arch, waste)
+	if config.ReportDir != "" {
+		path, err := WriteReport(config.ReportDir, report)
+		if err != nil {
+			log.Errorf(err, "unable to write audit report")
+		} else {
+			log.Infof("audit report written to %s", path)
+		}
+	}
+
+	return &lookout.EventResponse{
+		AnalyzerVersion: a.version,
+		Comments:        auditComments(report, waste),
+	}, nil
+}
+
+// auditComments returns a comment with the summary of the audit of a
+// repository, and a comment for each of the structs wasting the most
+// memory.
+func auditComments(report Report, waste []Waste) []*lookout.Comment {
+	if len(waste) == 0 {
 		return nil
 	}
 
+	result := []*lookout.Comment{{
+		Text: fmt.Sprintf(
+			"%d structs waste %d bytes on %s because of the order of their fields.",
+			len(report.Structs), report.Wasted, report.Arch,
+		),
+	}}
+
+	for i, w := range waste {
+		if i == maxAuditComments {
+			break
+		}
+
+		e := report.Structs[i]
+		log.Debugf("comment was added for the waste of struct %s", e.Name)
+		result = append(result, &lookout.Comment{
+			File: e.File,
+			Line: int32(e.Line),
+			Text: fmt.Sprintf(
+				"`%s` wastes %d bytes on %s: reordering its fields reduces its size from %d to %d bytes.\n\nHere's the proposed layout:\n\n```go\n%s\n```",
+				e.Name, e.Wasted, report.Arch, e.Size, e.OptimizedSize, w.Optimized,
+			),
+		})
+	}
+
+	return result
+}
+
+// fileChanges are the structs changed in a file of a review.
+type fileChanges struct {
+	// path is the path of the file in the head revision.
+	path string
+	// changed are the changed structs in the head revision, paired with
+	// their version in the base revision, if any.
+	changed []ChangedStruct
+	// removed are the structs of the base revision of the file that are
+	// not in its head revision.
+	removed []Struct
+}
+
+// commentsForReview returns the comments for all the changes of a review.
+// Structs that were moved to another file or renamed are matched with
+// their base version across all the files, and only reported if their
+// layout changed. The files of the head revision are read from the given
+// overlay, if present, or from the repository on disk. Packages are loaded
+// with the given session. If the files of the head revision are not all in
+// the directory or the overlay, checkout returns a directory where they
+// are, and a function to release it, to find the structs impacted by the
+// changes.
+func commentsForReview(
+	session *Session,
+	repoPath string,
+	overlay map[string][]byte,
+	importers func(dirs []string) (map[string][]byte, error),
+	changes []*lookout.Change,
+	config Config,
+) []*lookout.Comment {
+	base := baseOverlay(repoPath, overlay, changes)
+
+	var files []*fileChanges
+	var changed []ChangedStruct
+	var removed []Struct
+	for _, change := range changes {
+		if change.Head != nil && !config.forPath(change.Head.Path).analyzes(change.Head.Path) {
+			log.Debugf("skipping %q, which is not analyzed according to the config", change.Head.Path)
+			continue
+		}
+
+		fc := changesOfFile(session, repoPath, overlay, base, change, config)
+		files = append(files, fc)
+		changed = append(changed, fc.changed...)
+		removed = append(removed, fc.removed...)
+	}
+
+	changed = MatchMoved(changed, removed)
+
+	var result []*lookout.Comment
+	for _, fc := range files {
+		n := len(fc.changed)
+		fc.changed, changed = changed[:n], changed[n:]
+		result = append(result, commentsForFile(fc, config.forPath(fc.path))...)
+	}
+
+	if comment := impactComment(session, repoPath, overlay, importers, changes, files, config); comment != nil {
+		result = append(result, comment)
+	}
+
+	return result
+}
+
+// impactComment returns a comment for the whole review listing the structs
+// that were not changed but whose layout changed because they contain one
+// of the changed structs, or nil if there are none. The files of the
+// packages importing the changed ones are added to the given overlay by
+// importers, if given, for the directories of the changed packages,
+// relative to the given one.
+func impactComment(
+	session *Session,
+	repoPath string,
+	overlay map[string][]byte,
+	importers func(dirs []string) (map[string][]byte, error),
+	changes []*lookout.Change,
+	files []*fileChanges,
+	config Config,
+) *lookout.Comment {
+	var dirs []string
+	var names = make(map[string][]string)
+	for _, fc := range files {
+		for _, c := range fc.changed {
+			if c.Base == nil || c.Head.local || !layoutChanged(*c.Base, c.Head) {
+				continue
+			}
+
+			name := c.Head.Name
+			if c.Head.Generic != "" {
+				name = c.Head.Generic
+			}
+
+			dir := filepath.Dir(filepath.FromSlash(fc.path))
+			if _, ok := names[dir]; !ok {
+				dirs = append(dirs, dir)
+			}
+			names[dir] = append(names[dir], name)
+		}
+	}
+
+	if len(dirs) == 0 {
+		return nil
+	}
+
+	if importers != nil {
+		var slashed []string
+		for _, dir := range dirs {
+			slashed = append(slashed, filepath.ToSlash(dir))
+		}
+
+		fetched, err := importers(slashed)
+		if err != nil {
+			log.Errorf(err, "unable to fetch the packages impacted by the changes")
+			return nil
+		}
+
+		var all = make(map[string][]byte, len(overlay)+len(fetched))
+		for path, content := range overlay {
+			all[path] = content
+		}
+		for path, content := range fetched {
+			all[path] = content
+		}
+		overlay = all
+	}
+
+	var base = make(map[string][]byte)
+	var inReview = make(map[string]bool)
+	for _, change := range changes {
+		if change.Base != nil {
+			base[filepath.Join(repoPath, change.Base.Path)] = change.Base.Content
+		}
+		if change.Head != nil {
+			inReview[filepath.Join(repoPath, change.Head.Path)] = true
+		}
+	}
+
+	builds := config.Builds
+	if len(builds) == 0 {
+		builds = []Build{{}}
+	}
+
+	var lines []string
+	var seen = make(map[string]bool)
+	for _, dir := range dirs {
+		for _, build := range builds {
+			impacted, err := impact(session.Package, filepath.Join(repoPath, dir), overlay, base, names[dir], build)
+			if err != nil {
+				log.Errorf(err, "unable to get the structs impacted by the changes in %q", dir)
+				continue
+			}
+
+			for _, i := range impacted {
+				key := i.File + " " + i.Head.Name
+				if inReview[i.File] || seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				var sizes []string
+				for _, arch := range config.archs() {
+					b, h := i.Base.ForArch(arch), i.Head.ForArch(arch)
+					if b.Size() != h.Size() || b.Padding() != h.Padding() {
+						sizes = append(sizes, fmt.Sprintf(
+							"from %d to %d bytes (%d to %d bytes of padding) on %s",
+							b.Size(), h.Size(), b.Padding(), h.Padding(), arch,
+						))
+					}
+				}
+				if len(sizes) == 0 {
+					continue
+				}
+
+				path, err := filepath.Rel(repoPath, i.File)
+				if err != nil {
+					path = i.File
+				}
+
+				log.Debugf("struct %s is impacted by the changes in %s", i.Head.Name, i.Cause)
+				lines = append(lines, fmt.Sprintf(
+					"- `%s` in `%s:%d`, which contains `%s`: %s",
+					i.Head.Name, filepath.ToSlash(path), i.Head.Start, i.Cause, strings.Join(sizes, ", "),
+				))
+			}
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return &lookout.Comment{
+		Text: fmt.Sprintf(
+			"This change also modified the layout of structs that were not changed, because they contain the changed types:\n\n%s",
+			strings.Join(lines, "\n"),
+		),
+	}
+}
+
+// baseOverlay returns the overlay the files of the base revision of a
+// review are loaded with: the one of the head revision with the files of
+// the changes replaced by their base content, and the ones added by the
+// review removed. Files that did not change are the same in both
+// revisions.
+func baseOverlay(repoPath string, overlay map[string][]byte, changes []*lookout.Change) map[string][]byte {
+	var result = make(map[string][]byte, len(overlay)+len(changes))
+	for path, content := range overlay {
+		result[path] = content
+	}
+
+	for _, change := range changes {
+		if change.Head != nil {
+			result[filepath.Join(repoPath, change.Head.Path)] = nil
+		}
+	}
+
+	for _, change := range changes {
+		if change.Base != nil {
+			result[filepath.Join(repoPath, change.Base.Path)] = change.Base.Content
+		}
+	}
+	return result
+}
+
+// changesOfFile returns the structs changed in the file of the change. The
+// head and base revisions of the file are loaded with the given overlays.
+func changesOfFile(session *Session, repoPath string, overlay, baseFiles map[string][]byte, change *lookout.Change, config Config) *fileChanges {
+	var baseStructs []Struct
+	if change.Base != nil {
+		baseStructs = structsOfBase(session, repoPath, baseFiles, change.Base, config)
+	}
+
+	if change.Head == nil {
+		return &fileChanges{removed: baseStructs}
+	}
+
 	log.Infof("analyzing %q", change.Head.Path)
 
-	headStructs, err := StructsFromFile(filepath.Join(repoPath, change.Head.Path), change.Head.Content)
+	var headStructs []Struct
+	var err error
+	path := filepath.Join(repoPath, change.Head.Path)
+	if len(config.Builds) > 0 {
+		headStructs, err = session.StructVariants(path, change.Head.Content, config.Builds, overlay)
+	} else {
+		headStructs, err = session.Structs(path, change.Head.Content, Build{}, overlay)
+	}
 	if err != nil {
 		log.Errorf(err, "unable to get structs from head revision")
-		return nil
+		return &fileChanges{path: change.Head.Path}
 	}
 
 	var structNames []string
+	var inHead = make(map[string]bool)
 	for _, s := range headStructs {
 		structNames = append(structNames, s.Name)
+		inHead[s.Name] = true
 	}
 
 	log.Debugf("structs found in HEAD: %s", strings.Join(structNames, ", "))
@@ -112,31 +666,545 @@ func commentsForChanges(repoPath string, change *lookout.Change) []*lookout.Comm
 
 	log.Debugf("these structs changed: %s", strings.Join(structNames, ", "))
 
+	var removed []Struct
+	for _, s := range baseStructs {
+		if !inHead[s.Name] {
+			removed = append(removed, s)
+		}
+	}
+
+	return &fileChanges{
+		path:    change.Head.Path,
+		changed: PairChanged(baseStructs, changed),
+		removed: removed,
+	}
+}
+
+// commentsForFile returns the comments for the structs changed in a file.
+func commentsForFile(fc *fileChanges, config Config) []*lookout.Comment {
 	var result []*lookout.Comment
-	for _, c := range changed {
-		optimized := Optimize(c)
-		log.Debugf("for struct %q padding was %d, but could be optimized to %d", c.Name, c.Padding(), optimized.Padding())
-		if optimized.Padding() >= c.Padding() {
+	var structs []Struct
+	for _, c := range fc.changed {
+		if c.Base != nil && SameLayout(*c.Base, c.Head) {
+			log.Debugf("struct %s was moved or renamed without changing its layout", c.Head.Name)
+			continue
+		}
+		if config.ignores(c.Head) {
+			log.Debugf("struct %s is ignored by the config or a directive", c.Head.Name)
+			continue
+		}
+		structs = append(structs, c.Head)
+
+		if c.Base == nil {
 			continue
 		}
 
-		var comment = &lookout.Comment{
-			Line: int32(c.Start),
-			File: change.Head.Path,
+		if comment := regressionComment(c, config.archs()); comment != nil {
+			comment.File = fc.path
+			result = append(result, comment)
 		}
+	}
 
-		var buf bytes.Buffer
-		buf.WriteString("We've detected the memory layout could be improved to reduce padding.")
-		buf.WriteString("\n\n**Struct info:**\n")
-		for _, f := range c.Fields {
-			buf.WriteString(f.String())
-			buf.WriteRune('\n')
+	for _, group := range groupInstances(structs) {
+		var comments []*lookout.Comment
+		if group[0].Generic != "" {
+			comments = commentsForGeneric(group, config)
+		} else {
+			comments = commentsForStruct(group[0], config)
 		}
-		buf.WriteString(fmt.Sprintf("\nHere's the proposed layout:\n\n```go\n%s\n```", optimized))
-		log.Debugf("comment was added with suggestions for struct %s", c.Name)
-		comment.Text = buf.String()
+
+		for _, comment := range comments {
+			comment.File = fc.path
+			if len(config.Builds) > 0 {
+				comment.Text += fmt.Sprintf("\n\nThis applies to the build configurations %s.", buildsText(group[0].Builds))
+			}
+			result = append(result, comment)
+		}
+	}
+
+	return result
+}
+
+// commentsForStruct returns the comments with the problems found in the
+// given struct.
+func commentsForStruct(c Struct, config Config) []*lookout.Comment {
+	if config.ignores(c) {
+		log.Debugf("struct %s is ignored by the config or a directive", c.Name)
+		return nil
+	}
+
+	archs := config.archs()
+
+	var result []*lookout.Comment
+	if comment := misalignedAtomicsComment(c, archs); comment != nil {
 		result = append(result, comment)
 	}
 
+	if comment := falseSharingComment(c.ForArch(archs[0])); comment != nil {
+		result = append(result, comment)
+	}
+
+	result = append(result, elementSavingsComments(c.ForArch(archs[0]))...)
+
+	if c.KeepOrder {
+		log.Debugf("struct %s must keep its field order", c.Name)
+		return result
+	}
+
+	c = c.withHot(config.hot(c.Name))
+	optimized := OptimizeWith(c, Options{Archs: archs, PtrData: config.PtrData})
+
+	var before, after []Struct
+	var improvable []string
+	for _, arch := range archs {
+		b, a := c.ForArch(arch), optimized.ForArch(arch)
+		log.Debugf("for struct %q on %s padding was %d, but could be optimized to %d", c.Name, arch, b.Padding(), a.Padding())
+		if config.improves(b, a) {
+			improvable = append(improvable, arch)
+		}
+		before = append(before, b)
+		after = append(after, a)
+	}
+
+	if len(improvable) == 0 {
+		return result
+	}
+
+	var goal = "padding"
+	if config.PtrData {
+		goal = "padding and the memory scanned by the garbage collector"
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf(
+		"We've detected the memory layout could be improved to reduce %s on %s.",
+		goal, strings.Join(improvable, ", "),
+	))
+	if !config.compact() {
+		buf.WriteString("\n\n**Struct info:**\n\n")
+		buf.WriteString(fieldsTable(before))
+		buf.WriteString("\n**Sizes:**\n\n")
+		buf.WriteString(sizesTable(before, after))
+		if len(before[0].CacheLines(CacheLineSize)) > 1 || before[0].hotLines(CacheLineSize) > 0 {
+			buf.WriteString(fmt.Sprintf(
+				"\n**Cache lines on %s:**\n\nBefore:\n\n```\n%s```\n\nAfter:\n\n```\n%s```\n",
+				before[0].Arch,
+				cacheLinesMap(before[0], CacheLineSize),
+				cacheLinesMap(after[0], CacheLineSize),
+			))
+		}
+	} else {
+		buf.WriteString("\n")
+	}
+	buf.WriteString(fmt.Sprintf("\nHere's the proposed layout:\n\n```go\n%s\n```", optimized))
+	log.Debugf("comment was added with suggestions for struct %s", c.Name)
+
+	result = append(result, &lookout.Comment{
+		Line: int32(c.Start),
+		Text: buf.String(),
+	})
+	if config.compact() {
+		return result
+	}
+	return append(result, holeComments(before[0])...)
+}
+
+// elementSavingsComments returns a comment for every field of the struct
+// holding a named struct type, directly or in an array, whose layout could
+// be improved.
+func elementSavingsComments(s Struct) []*lookout.Comment {
+	var result []*lookout.Comment
+	for _, e := range ElementSavings(s) {
+		var text string
+		if e.Count > 1 {
+			text = fmt.Sprintf(
+				"The layout of `%s` wastes %d bytes per element on %s, which is %d bytes in `%s %s`. Consider optimizing it.",
+				e.Type, e.PerElement, s.Arch, e.Total(), e.Field.Name, e.Field.Type,
+			)
+		} else {
+			text = fmt.Sprintf(
+				"The layout of `%s` wastes %d bytes on %s, which also makes this struct bigger. Consider optimizing it.",
+				e.Type, e.PerElement, s.Arch,
+			)
+		}
+
+		line := e.Field.Position.Line
+		if line == 0 {
+			line = s.Start
+		}
+
+		log.Debugf("comment was added for the layout of %s in struct %s", e.Type, s.Name)
+		result = append(result, &lookout.Comment{
+			Line: int32(line),
+			Text: text,
+		})
+	}
+	return result
+}
+
+// holeComments returns a comment for every padding hole in the struct,
+// anchored at the field after which the padding is added.
+func holeComments(s Struct) []*lookout.Comment {
+	var result []*lookout.Comment
+	for _, h := range s.Holes() {
+		if h.After.Position.Line == 0 {
+			continue
+		}
+
+		text := fmt.Sprintf("%d bytes of padding after `%s %s` on %s", h.Size, h.After.Name, h.After.Type, s.Arch)
+		if h.Next != nil {
+			text += fmt.Sprintf(", because `%s %s` must be %d-byte aligned.", h.Next.Name, h.Next.Type, h.Next.Align)
+		} else {
+			text += fmt.Sprintf(", because the size of the struct must be a multiple of its %d-byte alignment.", s.Align())
+		}
+
+		result = append(result, &lookout.Comment{
+			Line: int32(h.After.Position.Line),
+			Text: text,
+		})
+	}
+	return result
+}
+
+// structsOfBase returns the structs in the given file of the base revision,
+// loaded with the given overlay of the base revision. If the structs
+// cannot be loaded, none are returned.
+func structsOfBase(session *Session, repoPath string, overlay map[string][]byte, file *lookout.File, config Config) []Struct {
+	var structs []Struct
+	var err error
+	path := filepath.Join(repoPath, file.Path)
+	if len(config.Builds) > 0 {
+		structs, err = session.StructVariants(path, file.Content, config.Builds, overlay)
+	} else {
+		structs, err = session.Structs(path, file.Content, Build{}, overlay)
+	}
+	if err != nil {
+		log.Debugf("unable to get structs from base revision of %q: %s", file.Path, err)
+		return nil
+	}
+	return structs
+}
+
+// regressionComment returns a comment for the changed struct if the change
+// made it grow with more padding, or reduced its padding, in any of the
+// given architectures, or nil otherwise.
+func regressionComment(c ChangedStruct, archs []string) *lookout.Comment {
+	var grew, improved []string
+	for _, arch := range archs {
+		base, head := c.Base.ForArch(arch), c.Head.ForArch(arch)
+		switch {
+		case head.Size() > base.Size() && head.Padding() > base.Padding():
+			grew = append(grew, fmt.Sprintf(
+				"- from %d to %d bytes on %s (+%d padding)",
+				base.Size(), head.Size(), arch, head.Padding()-base.Padding(),
+			))
+		case HasBetterAlignment(base, head):
+			improved = append(improved, fmt.Sprintf(
+				"- from %d to %d bytes of padding on %s",
+				base.Padding(), head.Padding(), arch,
+			))
+		}
+	}
+
+	var text string
+	switch {
+	case len(grew) > 0:
+		text = fmt.Sprintf(
+			"This change grew `%s` with more padding:\n\n%s\n\nConsider reordering its fields.",
+			c.Head.Name, strings.Join(grew, "\n"),
+		)
+		log.Debugf("comment was added for the growth of struct %s", c.Head.Name)
+	case len(improved) > 0:
+		text = fmt.Sprintf(
+			"Nice! This change reduced the padding of `%s`:\n\n%s",
+			c.Head.Name, strings.Join(improved, "\n"),
+		)
+		log.Debugf("comment was added for the improvement of struct %s", c.Head.Name)
+	default:
+		return nil
+	}
+
+	return &lookout.Comment{
+		Line: int32(c.Head.Start),
+		Text: text,
+	}
+}
+
+// groupInstances groups the instantiations of the same generic struct found
+// in the same build configurations, so they are reported together. Every
+// other struct is a group of its own.
+func groupInstances(structs []Struct) [][]Struct {
+	var result [][]Struct
+	var index = make(map[string]int)
+	for _, s := range structs {
+		if s.Generic == "" {
+			result = append(result, []Struct{s})
+			continue
+		}
+
+		key := s.Generic + " " + buildsText(s.Builds)
+		if i, ok := index[key]; ok {
+			result[i] = append(result[i], s)
+			continue
+		}
+
+		index[key] = len(result)
+		result = append(result, []Struct{s})
+	}
 	return result
 }
+
+// commentsForGeneric returns the comments with the problems found in the
+// given instantiations of the same generic struct. Since all of them share
+// the same declaration, a single field order is proposed for all of them.
+func commentsForGeneric(instances []Struct, config Config) []*lookout.Comment {
+	g := instances[0]
+	if config.ignores(g) {
+		log.Debugf("struct %s is ignored by the config or a directive", g.Generic)
+		return nil
+	}
+
+	archs := config.archs()
+
+	var result []*lookout.Comment
+	for _, inst := range instances {
+		if comment := misalignedAtomicsComment(inst, archs); comment != nil {
+			result = append(result, comment)
+		}
+	}
+
+	if g.KeepOrder {
+		log.Debugf("struct %s must keep its field order", g.Generic)
+		return result
+	}
+
+	optimized, single := OptimizeGeneric(instances, Options{
+		Archs:   archs,
+		PtrData: config.PtrData,
+		Hot:     config.hot(g.Generic),
+	})
+
+	var improvable []string
+	for i, inst := range instances {
+		for _, arch := range archs {
+			if config.improves(inst.withHot(config.hot(g.Generic)).ForArch(arch), optimized[i].ForArch(arch)) {
+				improvable = append(improvable, "`"+inst.Name+"`")
+				break
+			}
+		}
+	}
+
+	if len(improvable) == 0 {
+		return result
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf(
+		"We've detected the memory layout of the generic struct `%s` could be improved to reduce padding in %s.",
+		g.Generic, strings.Join(improvable, ", "),
+	))
+	if !config.compact() {
+		buf.WriteString("\n\n**Sizes:**\n\n")
+		buf.WriteString(instancesTable(instances, optimized, archs))
+	} else {
+		buf.WriteString("\n")
+	}
+	if !single {
+		buf.WriteString("\nNo single field order is optimal for every instantiation, so the proposed one minimizes their total size.\n")
+	}
+	buf.WriteString(fmt.Sprintf("\nHere's the proposed layout:\n\n```go\n%s\n```", optimized[0]))
+	log.Debugf("comment was added with suggestions for generic struct %s", g.Generic)
+
+	return append(result, &lookout.Comment{
+		Line: int32(g.Start),
+		Text: buf.String(),
+	})
+}
+
+// instancesTable returns a markdown table with the size of every
+// instantiation of a generic struct before and after being optimized in
+// several architectures.
+func instancesTable(before, after []Struct, archs []string) string {
+	var buf bytes.Buffer
+	buf.WriteString("| instantiation |")
+	for _, arch := range archs {
+		buf.WriteString(fmt.Sprintf(" %s |", arch))
+	}
+	buf.WriteString("\n|---|")
+	for range archs {
+		buf.WriteString("---|")
+	}
+	buf.WriteRune('\n')
+
+	for i := range before {
+		buf.WriteString(fmt.Sprintf("| `%s` |", before[i].Name))
+		for _, arch := range archs {
+			buf.WriteString(fmt.Sprintf(" %s |", change(before[i].ForArch(arch).Size(), after[i].ForArch(arch).Size())))
+		}
+		buf.WriteRune('\n')
+	}
+
+	return buf.String()
+}
+
+// misalignedAtomicsComment returns a comment for the struct if any of its
+// fields accessed with 64-bit atomic operations is misaligned in any of the
+// given architectures, or nil otherwise.
+func misalignedAtomicsComment(s Struct, archs []string) *lookout.Comment {
+	var misaligned = make(map[string][]string)
+	var names []string
+	for _, arch := range archs {
+		for _, f := range MisalignedAtomics(s.ForArch(arch)) {
+			if _, ok := misaligned[f.Name]; !ok {
+				names = append(names, f.Name)
+			}
+			misaligned[f.Name] = append(misaligned[f.Name], fmt.Sprintf("%s (offset %d)", arch, f.Start))
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Struct `%s` has fields accessed with 64-bit atomic operations that are not 64-bit aligned, which will panic at runtime:\n\n", s.Name))
+	for _, name := range names {
+		buf.WriteString(fmt.Sprintf("- `%s` on %s\n", name, strings.Join(misaligned[name], ", ")))
+	}
+	buf.WriteString("\nMove them to the beginning of the struct to guarantee their alignment.")
+	log.Debugf("comment was added for misaligned atomic fields in struct %s", s.Name)
+
+	return &lookout.Comment{
+		Line: int32(s.Start),
+		Text: buf.String(),
+	}
+}
+
+// falseSharingComment returns a comment for the struct if any of its
+// fields written independently by different goroutines share a cache line,
+// or nil otherwise.
+func falseSharingComment(s Struct) *lookout.Comment {
+	shared := FalseSharing(s, CacheLineSize)
+	if len(shared) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("Struct `%s` has fields written independently by different goroutines that share a cache line on %s, which causes false sharing:\n\n", s.Name, s.Arch))
+	for _, sl := range shared {
+		buf.WriteString(fmt.Sprintf("- `%s` (%s) and `%s` (%s) on line %d\n", sl.A.Name, guardsText(sl.A), sl.B.Name, guardsText(sl.B), sl.Line))
+	}
+
+	buf.WriteString("\nConsider reordering the fields so the ones written together are next to each other, or adding explicit padding:\n\n")
+	for _, sep := range Separations(s, CacheLineSize) {
+		buf.WriteString(fmt.Sprintf("- `_ [%d]byte` before `%s`\n", sep.Padding, sep.Field.Name))
+	}
+	log.Debugf("comment was added for false sharing in struct %s", s.Name)
+
+	return &lookout.Comment{
+		Line: int32(s.Start),
+		Text: buf.String(),
+	}
+}
+
+// guardsText returns a description of how a field is written.
+func guardsText(f Field) string {
+	if len(f.Guards) == 1 && f.Guards[0] == f.Name {
+		return "written atomically or locked"
+	}
+
+	var guards []string
+	for _, g := range f.Guards {
+		guards = append(guards, "`"+g+"`")
+	}
+	return "written holding " + strings.Join(guards, ", ")
+}
+
+// fieldsTable returns a markdown table with the offsets of the fields of
+// the same struct laid out for several architectures, side by side.
+func fieldsTable(layouts []Struct) string {
+	var buf bytes.Buffer
+	buf.WriteString("| field |")
+	for _, l := range layouts {
+		buf.WriteString(fmt.Sprintf(" %s |", l.Arch))
+	}
+	buf.WriteString("\n|---|")
+	for range layouts {
+		buf.WriteString("---|")
+	}
+	buf.WriteRune('\n')
+
+	cells := make([][]string, len(layouts))
+	for i, l := range layouts {
+		for _, f := range l.Fields {
+			if f.IsPadding {
+				last := len(cells[i]) - 1
+				if last >= 0 {
+					cells[i][last] += fmt.Sprintf(", +%d padding", f.Size)
+				}
+				continue
+			}
+			cells[i] = append(cells[i], fmt.Sprintf("%d-%d", f.Start, f.End))
+		}
+	}
+
+	var row int
+	for _, f := range layouts[0].Fields {
+		if f.IsPadding {
+			continue
+		}
+
+		buf.WriteString(fmt.Sprintf("| `%s %s` |", f.Name, f.Type))
+		for i := range layouts {
+			buf.WriteString(fmt.Sprintf(" %s |", cells[i][row]))
+		}
+		buf.WriteRune('\n')
+		row++
+	}
+
+	return buf.String()
+}
+
+// sizesTable returns a markdown table with the size, padding, bytes scanned
+// by the garbage collector and bytes actually allocated of a struct before
+// and after being optimized in several architectures.
+func sizesTable(before, after []Struct) string {
+	var buf bytes.Buffer
+	buf.WriteString("| |")
+	for _, b := range before {
+		buf.WriteString(fmt.Sprintf(" %s |", b.Arch))
+	}
+	buf.WriteString("\n|---|")
+	for range before {
+		buf.WriteString("---|")
+	}
+	buf.WriteRune('\n')
+
+	rows := []struct {
+		name  string
+		value func(Struct) int64
+	}{
+		{"size", Struct.Size},
+		{"padding", Struct.Padding},
+		{"scanned by GC", Struct.PtrData},
+		{"allocated", Struct.SizeClass},
+	}
+
+	for _, row := range rows {
+		buf.WriteString(fmt.Sprintf("| %s |", row.name))
+		for i := range before {
+			buf.WriteString(fmt.Sprintf(" %s |", change(row.value(before[i]), row.value(after[i]))))
+		}
+		buf.WriteRune('\n')
+	}
+
+	return buf.String()
+}
+
+// change returns a description of the change of a value.
+func change(before, after int64) string {
+	if before == after {
+		return fmt.Sprint(before)
+	}
+	return fmt.Sprintf("%d → %d (%+d)", before, after, after-before)
+}
@@ -0,0 +1,155 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	lookout "gopkg.in/src-d/lookout-sdk.v0/pb"
+)
+
+func TestChangesOfFileBase(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	const innerHead = "package a\n\ntype Inner struct {\n\tA int64\n}\n"
+	const outerHead = "package a\n\ntype Outer struct {\n\tI Inner\n\tB bool\n\tC bool\n}\n"
+	const added = "package a\n\ntype Added struct {\n\tA bool\n}\n"
+	writeFiles(t, tmp, map[string]string{
+		"go.mod":     "module example.com/root\n",
+		"a/inner.go": innerHead,
+		"a/outer.go": outerHead,
+		"a/added.go": added,
+	})
+
+	changes := []*lookout.Change{
+		{
+			Base: &lookout.File{Path: "a/inner.go", Content: []byte("package a\n\ntype Inner struct {\n\tA int32\n}\n")},
+			Head: &lookout.File{Path: "a/inner.go", Content: []byte(innerHead)},
+		},
+		{
+			Base: &lookout.File{Path: "a/outer.go", Content: []byte("package a\n\ntype Outer struct {\n\tB bool\n\tI Inner\n\tC bool\n}\n\ntype Added struct{}\n")},
+			Head: &lookout.File{Path: "a/outer.go", Content: []byte(outerHead)},
+		},
+		{
+			Head: &lookout.File{Path: "a/added.go", Content: []byte(added)},
+		},
+	}
+
+	// The base revision of outer.go is loaded with the base revision of
+	// inner.go, and without added.go, which did not exist.
+	base := baseOverlay(tmp, nil, changes)
+	fc := changesOfFile(NewSession(0), tmp, nil, base, changes[1], Config{})
+	require.Len(fc.changed, 1)
+	require.Equal("Outer", fc.changed[0].Head.Name)
+	require.NotNil(fc.changed[0].Base)
+	require.Equal(int64(12), fc.changed[0].Base.Size())
+	require.Equal(int64(16), fc.changed[0].Head.Size())
+}
+
+func TestImpactCommentImporters(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	const inner = "package a\n\ntype Inner struct {\n\tA int32\n\tB int32\n}\n"
+	overlay := map[string][]byte{
+		filepath.Join(tmp, "go.mod"):        []byte("module example.com/root\n"),
+		filepath.Join(tmp, "a", "inner.go"): []byte(inner),
+	}
+
+	changes := []*lookout.Change{{
+		Base: &lookout.File{Path: "a/inner.go", Content: []byte("package a\n\ntype Inner struct {\n\tA int32\n}\n")},
+		Head: &lookout.File{Path: "a/inner.go", Content: []byte(inner)},
+	}}
+
+	// Only the changed package is fetched, so the one importing it has to
+	// be fetched to find the impacted structs.
+	var requested []string
+	importers := func(dirs []string) (map[string][]byte, error) {
+		requested = dirs
+		return map[string][]byte{
+			filepath.Join(tmp, "b", "b.go"): []byte("package b\n\nimport \"example.com/root/a\"\n\ntype Wrapper struct {\n\tI a.Inner\n}\n"),
+		}, nil
+	}
+
+	var impact *lookout.Comment
+	for _, c := range commentsForReview(NewSession(0), tmp, overlay, importers, changes, Config{}) {
+		if c.File == "" {
+			impact = c
+		}
+	}
+	require.NotNil(impact)
+	require.Contains(impact.Text, "`Wrapper` in `b/b.go:5`")
+	require.Equal([]string{"a"}, requested)
+}
+
+func TestCommentsForReviewSession(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	files := map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a/a.go": "package a\n\nimport \"example.com/root/b\"\n\ntype A struct {\n\tX bool\n\tB b.B\n\tY bool\n}\n",
+		"b/b.go": "package b\n\ntype B struct {\n\tI int64\n}\n",
+	}
+	changeA := &lookout.Change{
+		Base: &lookout.File{Path: "a/a.go", Content: []byte("package a\n\nimport \"example.com/root/b\"\n\ntype A struct {\n\tB b.B\n\tX bool\n\tY bool\n}\n")},
+		Head: &lookout.File{Path: "a/a.go", Content: []byte(files["a/a.go"])},
+	}
+
+	overlay := func(files map[string]string) map[string][]byte {
+		var result = make(map[string][]byte)
+		for name, content := range files {
+			result[filepath.Join(tmp, filepath.FromSlash(name))] = []byte(content)
+		}
+		return result
+	}
+
+	session := NewSession(0)
+	first := commentsForReview(session, tmp, overlay(files), nil, []*lookout.Change{changeA}, Config{})
+	require.NotEmpty(first)
+
+	var loaded = make(map[*Package]bool)
+	for _, e := range session.entries {
+		loaded[e.pkg] = true
+	}
+
+	// The next review of the repository changes another package, so the
+	// packages of the first one are reused, even if the overlay is not the
+	// same.
+	files["c/c.go"] = "package c\n\ntype C struct {\n\tX bool\n\tI int64\n\tY bool\n}\n"
+	changeC := &lookout.Change{Head: &lookout.File{Path: "c/c.go", Content: []byte(files["c/c.go"])}}
+	second := commentsForReview(session, tmp, overlay(files), nil, []*lookout.Change{changeA, changeC}, Config{})
+	require.Equal(first, second[:len(first)])
+
+	var reused int
+	for _, e := range session.entries {
+		if loaded[e.pkg] {
+			reused++
+		}
+	}
+	require.Equal(len(loaded), reused)
+	require.Len(session.entries, len(loaded)+1)
+
+	// Packages are loaded again when the ones they import change.
+	files["b/b.go"] = "package b\n\ntype B struct {\n\tI int32\n}\n"
+	third := commentsForReview(session, tmp, overlay(files), nil, []*lookout.Change{changeA}, Config{})
+	require.NotEqual(first, third)
+}
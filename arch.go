@@ -0,0 +1,33 @@
+package memlayout
+
+import (
+	"fmt"
+	"go/types"
+)
+
+// DefaultArch is the architecture used to compute the layout of structs
+// when no other architecture is requested.
+const DefaultArch = "amd64"
+
+// DefaultArchs are the target architectures reported by default.
+var DefaultArchs = []string{"amd64", "arm64", "386", "arm", "wasm"}
+
+// sizesFor returns the sizes used by the gc compiler in the given
+// architecture. Unknown architectures fall back to DefaultArch.
+func sizesFor(arch string) types.Sizes {
+	if s := types.SizesFor("gc", arch); s != nil {
+		return s
+	}
+	return types.SizesFor("gc", DefaultArch)
+}
+
+// ValidateArchs returns an error if any of the given architectures is not
+// supported by the gc compiler.
+func ValidateArchs(archs []string) error {
+	for _, arch := range archs {
+		if types.SizesFor("gc", arch) == nil {
+			return fmt.Errorf("unsupported architecture %q", arch)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package memlayout
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// atomic64Funcs are the functions of sync/atomic that require their
+// operand to be 64-bit aligned.
+var atomic64Funcs = map[string]bool{
+	"AddInt64":             true,
+	"AddUint64":            true,
+	"AndInt64":             true,
+	"AndUint64":            true,
+	"CompareAndSwapInt64":  true,
+	"CompareAndSwapUint64": true,
+	"LoadInt64":            true,
+	"LoadUint64":           true,
+	"OrInt64":              true,
+	"OrUint64":             true,
+	"StoreInt64":           true,
+	"StoreUint64":          true,
+	"SwapInt64":            true,
+	"SwapUint64":           true,
+}
+
+// atomic64Types are the types of sync/atomic holding 64-bit values.
+var atomic64Types = map[string]bool{
+	"Int64":  true,
+	"Uint64": true,
+}
+
+// atomicFields returns the struct fields that are accessed with 64-bit
+// atomic operations in the given files, such as `atomic.AddInt64(&x.f, 1)`.
+func atomicFields(info *types.Info, files []*ast.File) map[*types.Var]bool {
+	result := make(map[*types.Var]bool)
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 || !isAtomic64Call(info, call) {
+				return true
+			}
+
+			addr, ok := astutil.Unparen(call.Args[0]).(*ast.UnaryExpr)
+			if !ok || addr.Op != token.AND {
+				return true
+			}
+
+			sel, ok := astutil.Unparen(addr.X).(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+
+			if s, ok := info.Selections[sel]; ok && s.Kind() == types.FieldVal {
+				result[s.Obj().(*types.Var)] = true
+			}
+
+			return true
+		})
+	}
+	return result
+}
+
+func isAtomic64Call(info *types.Info, call *ast.CallExpr) bool {
+	sel, ok := astutil.Unparen(call.Fun).(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+
+	fn, ok := info.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil || fn.Pkg().Path() != "sync/atomic" {
+		return false
+	}
+
+	return atomic64Funcs[fn.Name()]
+}
+
+// isAtomic64Type reports whether the type is one of the 64-bit types of
+// sync/atomic, such as atomic.Int64.
+func isAtomic64Type(typ types.Type) bool {
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return false
+	}
+
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "sync/atomic" &&
+		atomic64Types[obj.Name()]
+}
+
+// MisalignedAtomics returns the fields of the struct accessed with 64-bit
+// atomic operations that are not 64-bit aligned in the architecture of the
+// struct. On 32-bit architectures such as 386 or arm only the first word of
+// an allocated struct is guaranteed to be 64-bit aligned, and atomic
+// operations on misaligned values panic.
+func MisalignedAtomics(s Struct) []Field {
+	var result []Field
+	for _, f := range s.Fields {
+		if f.Atomic64 && f.Start%8 != 0 {
+			result = append(result, f)
+		}
+	}
+	return result
+}
@@ -0,0 +1,116 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const atomicSource = `
+package foo
+
+import "sync/atomic"
+
+type Counter struct {
+	Name  string
+	Done  bool
+	Hits  int64
+	Total atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.Hits, 1)
+}
+`
+
+func TestAtomicFields(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(atomicSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(atomicSource))
+	require.NoError(err)
+	require.Len(structs, 1)
+
+	var atomics []string
+	for _, f := range structs[0].Fields {
+		if f.Atomic64 {
+			atomics = append(atomics, f.Name)
+		}
+	}
+	require.Equal([]string{"Hits", "Total"}, atomics)
+
+	require.Len(MisalignedAtomics(structs[0]), 0)
+
+	misaligned := MisalignedAtomics(structs[0].ForArch("386"))
+	require.Len(misaligned, 1)
+	require.Equal("Hits", misaligned[0].Name)
+	require.Equal(int64(12), misaligned[0].Start)
+
+	optimized := Optimize(structs[0].ForArch("386"))
+	require.Equal("Total", optimized.Fields[0].Name)
+	require.Equal("Hits", optimized.Fields[1].Name)
+	require.Len(MisalignedAtomics(optimized), 0)
+}
+
+const pinnedAtomicSource = `
+package foo
+
+import "sync/atomic"
+
+type Counter struct {
+	flag bool //memlayout:first
+	x    int32
+	n    int64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.n, 1)
+}
+
+type Gap struct {
+	flag bool //memlayout:first
+	n    int64
+	b    [8]bool
+}
+
+func (g *Gap) Inc() {
+	atomic.AddInt64(&g.n, 1)
+}
+`
+
+func TestOptimizePinnedAtomics(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(pinnedAtomicSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(pinnedAtomicSource))
+	require.NoError(err)
+	require.Len(structs, 2)
+
+	opts := Options{Archs: []string{"amd64", "386"}}
+	optimized := OptimizeWith(structs[0], opts)
+	require.Equal([]string{"flag", "x", "n"}, fieldNames(optimized.Fields))
+	require.Len(MisalignedAtomics(optimized.ForArch("386")), 0)
+
+	// The gap after flag cannot be filled, so the struct is kept as it is.
+	optimized = OptimizeWith(structs[1].ForArch("386"), opts)
+	require.Equal([]string{"flag", "n", "b"}, fieldNames(optimized.Fields))
+}
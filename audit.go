@@ -0,0 +1,256 @@
+package memlayout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Waste is a struct whose layout wastes memory on an architecture, because
+// reordering its fields would make it smaller.
+type Waste struct {
+	// Struct is the struct with its current layout.
+	Struct Struct
+	// Optimized is the struct with its optimal layout.
+	Optimized Struct
+	// File is the path of the file the struct is declared in.
+	File string
+	// Package is the import path of the package of the struct.
+	Package string
+}
+
+// Wasted returns the number of bytes the struct would be reduced by with
+// its optimal layout.
+func (w Waste) Wasted() int64 {
+	return w.Struct.Size() - w.Optimized.Size()
+}
+
+// Audit returns the structs of all the packages in the given directory and
+// its subdirectories whose layout wastes memory on the given architecture,
+// loaded for the given build configuration. The packages of every module
+// in the directory are audited, including nested ones. Structs are sorted
+// from the most to the least wasted bytes. Packages that cannot be loaded
+// are skipped, and returned as errors along with the result.
+func Audit(dir string, build Build, arch string) ([]Waste, []error, error) {
+	return audit(LoadPackage, dir, build, arch)
+}
+
+// audit returns the structs wasting memory like Audit, loading the
+// packages with the given function.
+func audit(load loadFunc, dir string, build Build, arch string) ([]Waste, []error, error) {
+	listed, err := listModules(dir, build)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result []Waste
+	var errs []error
+	for _, p := range listed {
+		pkg, err := load(p.Dir, nil, build)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, f := range pkg.Files {
+			// Structs of tests are not worth auditing.
+			filename := pkg.Fset.File(f.Pos()).Name()
+			if strings.HasSuffix(filename, "_test.go") {
+				continue
+			}
+
+			for _, s := range pkg.structs(f, build) {
+				if s.Ignore || s.KeepOrder {
+					continue
+				}
+
+				s = s.ForArch(arch)
+				w := Waste{
+					Struct:    s,
+					Optimized: Optimize(s),
+					File:      filename,
+					Package:   pkg.Path,
+				}
+				if w.Wasted() > 0 {
+					result = append(result, w)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Wasted() != result[j].Wasted() {
+			return result[i].Wasted() > result[j].Wasted()
+		}
+		if result[i].File != result[j].File {
+			return result[i].File < result[j].File
+		}
+		return result[i].Struct.Start < result[j].Struct.Start
+	})
+
+	return result, errs, nil
+}
+
+// listModules lists the packages of every module in the given directory
+// and its subdirectories, or the ones of the directory itself if there are
+// no modules in it.
+func listModules(dir string, build Build) ([]listedPackage, error) {
+	modules, err := findModules(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(modules) == 0 {
+		return goListAll(dir, build, nil)
+	}
+
+	var result []listedPackage
+	seen := make(map[string]bool)
+	for _, module := range modules {
+		listed, err := goListAll(module, build, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// In a workspace, the packages of nested modules are also
+		// listed by the modules containing them.
+		for _, p := range listed {
+			if !seen[p.Dir] {
+				seen[p.Dir] = true
+				result = append(result, p)
+			}
+		}
+	}
+	return result, nil
+}
+
+// findModules returns the directories of the modules in the given directory
+// and its subdirectories, skipping the ones the go command ignores.
+func findModules(dir string) ([]string, error) {
+	var result []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			name := info.Name()
+			if path != dir && (name == "vendor" || name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.Name() == "go.mod" {
+			result = append(result, filepath.Dir(path))
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Report is the machine-readable result of the audit of a repository.
+type Report struct {
+	Repository string    `json:"repository"`
+	Revision   string    `json:"revision"`
+	Time       time.Time `json:"time"`
+	Arch       string    `json:"arch"`
+	// Wasted is the total number of bytes wasted by the structs.
+	Wasted  int64         `json:"wasted"`
+	Structs []ReportEntry `json:"structs"`
+}
+
+// ReportEntry is a struct in a Report.
+type ReportEntry struct {
+	Package       string `json:"package"`
+	File          string `json:"file"`
+	Line          int    `json:"line"`
+	Name          string `json:"name"`
+	Size          int64  `json:"size"`
+	OptimizedSize int64  `json:"optimized_size"`
+	Padding       int64  `json:"padding"`
+	Wasted        int64  `json:"wasted"`
+}
+
+// NewReport returns the report of the audit of the given revision of a
+// repository, whose sources are in the given directory. File paths in the
+// report are relative to that directory.
+func NewReport(repository, revision, dir, arch string, waste []Waste) Report {
+	r := Report{
+		Repository: repository,
+		Revision:   revision,
+		Time:       time.Now().UTC(),
+		Arch:       arch,
+		Structs:    []ReportEntry{},
+	}
+
+	for _, w := range waste {
+		file, err := filepath.Rel(dir, w.File)
+		if err != nil {
+			file = w.File
+		}
+
+		r.Wasted += w.Wasted()
+		r.Structs = append(r.Structs, ReportEntry{
+			Package:       w.Package,
+			File:          filepath.ToSlash(file),
+			Line:          w.Struct.Start,
+			Name:          w.Struct.Name,
+			Size:          w.Struct.Size(),
+			OptimizedSize: w.Optimized.Size(),
+			Padding:       w.Struct.Padding(),
+			Wasted:        w.Wasted(),
+		})
+	}
+
+	return r
+}
+
+// WriteReport writes the report as JSON in the given directory, in a
+// subdirectory for its repository, and returns the path of the file.
+func WriteReport(dir string, r Report) (string, error) {
+	path := filepath.Join(
+		dir,
+		reportName(r.Repository),
+		fmt.Sprintf("%s-%s.json", r.Time.Format("20060102T150405Z"), r.Revision),
+	)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// reportName returns a name for the directory of the reports of the given
+// repository that is safe to use in any filesystem.
+func reportName(repository string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimSuffix(repository, ".git"))
+
+	if name == "" {
+		return "_"
+	}
+	return name
+}
@@ -0,0 +1,101 @@
+package memlayout
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a/a.go": "package a\n\ntype Small struct {\n\tA bool\n\tB int32\n\tC bool\n}\n\ntype Good struct {\n\tA int64\n\tB bool\n}\n",
+		"b/b.go": "package b\n\ntype Big struct {\n\tA bool\n\tB int64\n\tC bool\n}\n\n//memlayout:ignore\ntype Ignored struct {\n\tA bool\n\tB int64\n\tC bool\n}\n",
+	})
+
+	waste, errs, err := Audit(tmp, Build{}, "amd64")
+	require.NoError(err)
+	require.Len(errs, 0)
+	require.Len(waste, 2)
+
+	require.Equal("Big", waste[0].Struct.Name)
+	require.Equal("example.com/root/b", waste[0].Package)
+	require.Equal(int64(8), waste[0].Wasted())
+	require.Equal("Small", waste[1].Struct.Name)
+	require.Equal(int64(4), waste[1].Wasted())
+
+	report := NewReport("git://example.com/root.git", "abc", tmp, "amd64", waste)
+	require.Equal(int64(12), report.Wasted)
+	require.Equal("b/b.go", report.Structs[0].File)
+	require.Equal(3, report.Structs[0].Line)
+
+	dir := filepath.Join(tmp, "reports")
+	path, err := WriteReport(dir, report)
+	require.NoError(err)
+	require.Equal(filepath.Join(dir, "git___example.com_root"), filepath.Dir(path))
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(err)
+
+	var decoded Report
+	require.NoError(json.Unmarshal(data, &decoded))
+	require.Equal(report.Structs, decoded.Structs)
+	require.Equal(report.Wasted, decoded.Wasted)
+}
+
+func TestAuditModules(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod":            "module example.com/root\n",
+		"a/a.go":            "package a\n\ntype Small struct {\n\tA bool\n\tB int32\n\tC bool\n}\n",
+		"a/sub/go.mod":      "module example.com/sub\n",
+		"a/sub/sub.go":      "package sub\n\ntype Big struct {\n\tA bool\n\tB int64\n\tC bool\n}\n",
+		"b/go.mod":          "module example.com/b\n",
+		"b/b.go":            "package b\n\ntype Big struct {\n\tA bool\n\tB int64\n\tC bool\n}\n",
+		"b/testdata/go.mod": "module example.com/testdata\n",
+		"b/testdata/t.go":   "package t\n\ntype Big struct {\n\tA bool\n\tB int64\n\tC bool\n}\n",
+	})
+
+	waste, errs, err := Audit(tmp, Build{}, "amd64")
+	require.NoError(err)
+	require.Len(errs, 0)
+	require.Equal([]string{"example.com/sub", "example.com/b", "example.com/root/a"}, wastePackages(waste))
+
+	// Without a module at the root, the nested ones are still audited.
+	require.NoError(os.Remove(filepath.Join(tmp, "go.mod")))
+	writeFiles(t, tmp, map[string]string{
+		"a/go.mod": "module example.com/a\n",
+	})
+
+	waste, errs, err = Audit(tmp, Build{}, "amd64")
+	require.NoError(err)
+	require.Len(errs, 0)
+	require.Equal([]string{"example.com/sub", "example.com/b", "example.com/a"}, wastePackages(waste))
+}
+
+func wastePackages(waste []Waste) []string {
+	var result []string
+	for _, w := range waste {
+		result = append(result, w.Package)
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package memlayout
+
+import (
+	"fmt"
+	"go/build"
+	"strings"
+)
+
+// Build is a build configuration packages can be loaded for. Empty fields
+// take the value of the host.
+type Build struct {
+	GOOS   string
+	GOARCH string
+	Tags   []string
+}
+
+// ParseBuild parses a build configuration in the form
+// `GOOS/GOARCH[:tag,tag...]`, such as `linux/arm64:netgo`.
+func ParseBuild(s string) (Build, error) {
+	var b Build
+	target := s
+	if i := strings.Index(s, ":"); i >= 0 {
+		target = s[:i]
+		if tags := s[i+1:]; tags != "" {
+			b.Tags = strings.Split(tags, ",")
+		}
+	}
+
+	parts := strings.Split(target, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Build{}, fmt.Errorf("invalid build configuration %q, expected GOOS/GOARCH[:tags]", s)
+	}
+
+	b.GOOS, b.GOARCH = parts[0], parts[1]
+	if err := ValidateArchs([]string{b.GOARCH}); err != nil {
+		return Build{}, err
+	}
+
+	return b, nil
+}
+
+func (b Build) goos() string {
+	if b.GOOS == "" {
+		return build.Default.GOOS
+	}
+	return b.GOOS
+}
+
+func (b Build) goarch() string {
+	if b.GOARCH == "" {
+		return build.Default.GOARCH
+	}
+	return b.GOARCH
+}
+
+func (b Build) String() string {
+	s := b.goos() + "/" + b.goarch()
+	if len(b.Tags) > 0 {
+		s += ":" + strings.Join(b.Tags, ",")
+	}
+	return s
+}
+
+// env returns the environment variables the go command has to be run with
+// to load packages for the build.
+func (b Build) env() []string {
+	var env []string
+	if b.GOOS != "" {
+		env = append(env, "GOOS="+b.GOOS)
+	}
+	if b.GOARCH != "" {
+		env = append(env, "GOARCH="+b.GOARCH)
+	}
+	return env
+}
+
+// flags returns the flags the go command has to be run with to load
+// packages for the build.
+func (b Build) flags() []string {
+	if len(b.Tags) == 0 {
+		return nil
+	}
+	return []string{"-tags=" + strings.Join(b.Tags, ",")}
+}
+
+// buildsText returns a human readable list of build configurations.
+func buildsText(builds []Build) string {
+	var names []string
+	for _, b := range builds {
+		names = append(names, b.String())
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,87 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBuild(t *testing.T) {
+	require := require.New(t)
+
+	b, err := ParseBuild("linux/arm64:netgo,osusergo")
+	require.NoError(err)
+	require.Equal(Build{GOOS: "linux", GOARCH: "arm64", Tags: []string{"netgo", "osusergo"}}, b)
+	require.Equal("linux/arm64:netgo,osusergo", b.String())
+
+	b, err = ParseBuild("windows/386")
+	require.NoError(err)
+	require.Equal(Build{GOOS: "windows", GOARCH: "386"}, b)
+
+	_, err = ParseBuild("linux")
+	require.Error(err)
+
+	_, err = ParseBuild("linux/foo")
+	require.Error(err)
+}
+
+func TestStructVariants(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	const common = "package foo\n\ntype File struct {\n\tClosed bool\n\tFd     fd\n\tName   string\n}\n"
+	writeFiles(t, tmp, map[string]string{
+		"file.go":         common,
+		"fd_linux.go":     "package foo\n\ntype fd int32\n",
+		"fd_windows.go":   "package foo\n\ntype fd uintptr\n",
+		"extra_linux.go":  "package foo\n\ntype Extra struct {\n\tA bool\n}\n",
+		"tagged_debug.go": "//go:build debug\n\npackage foo\n\ntype Debug struct {\n\tA bool\n}\n",
+	})
+
+	linux := Build{GOOS: "linux", GOARCH: "amd64"}
+	linuxArm := Build{GOOS: "linux", GOARCH: "arm64"}
+	windows := Build{GOOS: "windows", GOARCH: "amd64"}
+	debug := Build{GOOS: "linux", GOARCH: "amd64", Tags: []string{"debug"}}
+
+	structs, err := StructVariants(filepath.Join(tmp, "file.go"), []byte(common), []Build{linux, linuxArm, windows})
+	require.NoError(err)
+	require.Len(structs, 2)
+
+	require.Equal("File", structs[0].Name)
+	require.Equal([]Build{linux, linuxArm}, structs[0].Builds)
+	require.Equal(int64(24), structs[0].Size())
+
+	require.Equal("File", structs[1].Name)
+	require.Equal([]Build{windows}, structs[1].Builds)
+	require.Equal(int64(32), structs[1].Size())
+
+	content, err := ioutil.ReadFile(filepath.Join(tmp, "extra_linux.go"))
+	require.NoError(err)
+	structs, err = StructVariants(filepath.Join(tmp, "extra_linux.go"), content, []Build{linux, windows})
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal([]Build{linux}, structs[0].Builds)
+
+	content, err = ioutil.ReadFile(filepath.Join(tmp, "tagged_debug.go"))
+	require.NoError(err)
+	structs, err = StructVariants(filepath.Join(tmp, "tagged_debug.go"), content, []Build{linux, debug})
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal([]Build{debug}, structs[0].Builds)
+
+	// Builds that exclude the whole package are skipped too.
+	const platform = "package bar\n\ntype P struct {\n\tA bool\n}\n"
+	writeFiles(t, tmp, map[string]string{"bar/p_linux.go": platform})
+	structs, err = StructVariants(filepath.Join(tmp, "bar", "p_linux.go"), []byte(platform), []Build{linux, windows})
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal([]Build{linux}, structs[0].Builds)
+}
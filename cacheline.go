@@ -0,0 +1,103 @@
+package memlayout
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CacheLineSize is the size in bytes of a cache line in the most common
+// architectures.
+const CacheLineSize = 64
+
+// CacheLine is a cache line of a struct with the fields that have at least
+// one byte in it, assuming the struct starts at the beginning of a line.
+type CacheLine struct {
+	Index  int
+	Fields []Field
+}
+
+// CacheLines returns the cache lines of the given size the struct spans.
+func (s Struct) CacheLines(lineSize int64) []CacheLine {
+	var lines []CacheLine
+	for _, f := range s.Fields {
+		if f.IsPadding || f.Size == 0 {
+			continue
+		}
+
+		first, last := int(f.Start/lineSize), int((f.End-1)/lineSize)
+		for len(lines) <= last {
+			lines = append(lines, CacheLine{Index: len(lines)})
+		}
+
+		for i := first; i <= last; i++ {
+			lines[i].Fields = append(lines[i].Fields, f)
+		}
+	}
+	return lines
+}
+
+// Straddles reports whether the field spans more than one cache line of
+// the given size.
+func (f Field) Straddles(lineSize int64) bool {
+	return f.Size > 0 && f.Start/lineSize != (f.End-1)/lineSize
+}
+
+// hotLines returns the number of cache lines of the given size with hot
+// fields in them.
+func (s Struct) hotLines(lineSize int64) int {
+	var result int
+	for _, line := range s.CacheLines(lineSize) {
+		for _, f := range line.Fields {
+			if f.Hot {
+				result++
+				break
+			}
+		}
+	}
+	return result
+}
+
+// withHot returns the struct with the fields with the given names marked
+// as hot.
+func (s Struct) withHot(names []string) Struct {
+	if len(names) == 0 {
+		return s
+	}
+
+	hot := make(map[string]bool)
+	for _, name := range names {
+		hot[name] = true
+	}
+
+	fields := make([]Field, len(s.Fields))
+	copy(fields, s.Fields)
+	for i := range fields {
+		if !fields[i].IsPadding && hot[fields[i].Name] {
+			fields[i].Hot = true
+		}
+	}
+
+	s.Fields = fields
+	return s
+}
+
+// cacheLinesMap returns a human readable map of the cache lines of the
+// given size of the struct.
+func cacheLinesMap(s Struct, lineSize int64) string {
+	var buf strings.Builder
+	for _, line := range s.CacheLines(lineSize) {
+		var names []string
+		for _, f := range line.Fields {
+			name := f.Name
+			if f.Hot {
+				name += " (hot)"
+			}
+			if f.Straddles(lineSize) {
+				name += " (straddles)"
+			}
+			names = append(names, name)
+		}
+		buf.WriteString(fmt.Sprintf("line %d: %s\n", line.Index, strings.Join(names, ", ")))
+	}
+	return buf.String()
+}
@@ -0,0 +1,74 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const cacheLinesSource = `
+package foo
+
+type Foo struct {
+	Name    string
+	Buf     [50]byte
+	Enabled bool
+	Count   int64
+	//memlayout:hot
+	Hits  int32
+	Flags uint16 //memlayout:hot
+}
+`
+
+func TestCacheLines(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(cacheLinesSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(cacheLinesSource))
+	require.NoError(err)
+	require.Len(structs, 1)
+
+	lines := structs[0].CacheLines(CacheLineSize)
+	require.Equal([][]string{
+		{"Name", "Buf"},
+		{"Buf", "Enabled", "Count", "Hits", "Flags"},
+	}, lineNames(lines))
+
+	for _, f := range structs[0].Fields {
+		require.Equal(f.Name == "Buf", f.Straddles(CacheLineSize), f.Name)
+	}
+
+	optimized := Optimize(structs[0])
+	require.Equal(structs[0].Size(), optimized.Size())
+	require.Equal([][]string{
+		{"Hits", "Flags", "Enabled", "Name", "Count", "Buf"},
+		{"Buf"},
+	}, lineNames(optimized.CacheLines(CacheLineSize)))
+
+	optimized = OptimizeWith(structs[0], Options{Hot: []string{"Count"}})
+	require.Equal(int64(8), optimized.Fields[0].Size)
+	require.Equal("Count", optimized.Fields[0].Name)
+}
+
+func lineNames(lines []CacheLine) [][]string {
+	var result [][]string
+	for _, l := range lines {
+		var names []string
+		for _, f := range l.Fields {
+			names = append(names, f.Name)
+		}
+		result = append(result, names)
+	}
+	return result
+}
@@ -1,37 +1,356 @@
 package memlayout
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
+	"gopkg.in/src-d/go-billy.v4/osfs"
 	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	lookout "gopkg.in/src-d/lookout-sdk.v0/pb"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/index"
+	"gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
 )
 
-func clone(review *lookout.ReviewEvent) (string, error) {
-	tmp, err := ioutil.TempDir(os.TempDir(), "memlayout-")
+// CloneCache keeps a bare clone of every repository in a directory, so only
+// the objects that are new are fetched for every event. Revisions are
+// checked out in worktrees that share the objects of the clone. Clones
+// that were not used for longer than the maximum age are removed, and so
+// are the least recently used ones while the cache is bigger than its
+// maximum size.
+type CloneCache struct {
+	dir     string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu sync.Mutex
+	// repos are the clones of the cache by directory, which is named after
+	// a hash of their URL.
+	repos map[string]*cachedRepo
+}
+
+// cachedRepo is a clone of a CloneCache.
+type cachedRepo struct {
+	sync.Mutex
+	// users is the number of worktrees of the clone in use.
+	users int
+	// size is the total size of the files of the clone after it was last
+	// fetched. It is guarded by the lock of the cache.
+	size int64
+}
+
+// NewCloneCache returns a clone cache in the given directory, which is
+// created if needed. Worktrees left by previous processes are removed. A
+// maximum size or age of zero means no limit.
+func NewCloneCache(dir string, maxSize int64, maxAge time.Duration) (*CloneCache, error) {
+	if err := os.RemoveAll(filepath.Join(dir, "worktrees")); err != nil {
+		return nil, err
+	}
+
+	for _, d := range []string{"repos", "worktrees"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	// The size of the clones left by previous processes is only computed
+	// once, the ones of the clones fetched later are tracked.
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "repos"))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	r, err := git.PlainClone(tmp, false, &git.CloneOptions{
-		URL: review.Head.InternalRepositoryURL,
-	})
+	repos := make(map[string]*cachedRepo, len(infos))
+	for _, info := range infos {
+		repoDir := filepath.Join(dir, "repos", info.Name())
+		repos[repoDir] = &cachedRepo{size: dirSize(repoDir)}
+	}
+
+	return &CloneCache{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		repos:   repos,
+	}, nil
+}
 
+// IsDefault returns whether the given reference is the default branch of
+// the repository with the given URL. The repository is cloned if it is not
+// in the cache yet, or else the new objects are fetched, but nothing is
+// checked out.
+func (c *CloneCache) IsDefault(url, hash string, ref plumbing.ReferenceName) (bool, error) {
+	repoDir := c.repoDir(url)
+	repo := c.acquire(repoDir)
+	defer c.release(repoDir)
+
+	repo.Lock()
+	defer repo.Unlock()
+
+	r, err := c.fetch(repo, repoDir, url, hash, ref)
+	if err != nil {
+		return false, err
+	}
+
+	head, err := r.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return false, err
+	}
+
+	return head.Target() == ref, nil
+}
+
+// Checkout returns a directory with the given hash of the repository with
+// the given URL checked out. The repository is cloned if it is not in the
+// cache yet, or else the new objects are fetched. The returned function
+// removes the directory, and must be called once it is not needed anymore.
+func (c *CloneCache) Checkout(url, hash string, ref plumbing.ReferenceName) (string, func(), error) {
+	repoDir := c.repoDir(url)
+	repo := c.acquire(repoDir)
+
+	dir, err := c.checkout(repo, repoDir, url, hash, ref)
+	if err != nil {
+		c.release(repoDir)
+		return "", nil, err
+	}
+
+	return dir, func() {
+		os.RemoveAll(dir)
+		c.release(repoDir)
+	}, nil
+}
+
+// repoDir returns the directory of the clone of the repository with the
+// given URL.
+func (c *CloneCache) repoDir(url string) string {
+	return filepath.Join(c.dir, "repos", repoHash(url)+".git")
+}
+
+// repoHash returns a hash of the URL of a repository to name its
+// directories, as different URLs may have the same report name.
+func repoHash(url string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(url)))
+}
+
+func (c *CloneCache) checkout(repo *cachedRepo, repoDir, url, hash string, ref plumbing.ReferenceName) (string, error) {
+	repo.Lock()
+	defer repo.Unlock()
+
+	r, err := c.fetch(repo, repoDir, url, hash, ref)
 	if err != nil {
 		return "", err
 	}
-	w, err := r.Worktree()
+
+	dir, err := ioutil.TempDir(filepath.Join(c.dir, "worktrees"), reportName(url)+"-")
 	if err != nil {
 		return "", err
 	}
 
-	err = w.Checkout(&git.CheckoutOptions{
-		Hash: plumbing.NewHash(review.Head.Hash),
+	if err := checkoutWorktree(r.Storer, dir, hash); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// fetch fetches the given hash of the repository with the given URL into
+// its clone in the given directory, marks the clone as used and updates
+// its size. It must be called with the lock of the clone held.
+func (c *CloneCache) fetch(repo *cachedRepo, repoDir, url, hash string, ref plumbing.ReferenceName) (*git.Repository, error) {
+	r, err := fetch(repoDir, url, hash, ref)
+
+	size := dirSize(repoDir)
+	c.mu.Lock()
+	repo.size = size
+	c.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(repoDir, now, now); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// fetch clones the repository with the given URL as a bare repository in
+// the given directory, or fetches the objects that are new if it already
+// exists. The given reference is fetched too if the given hash is not
+// reachable from the branches.
+func fetch(dir, url, hash string, ref plumbing.ReferenceName) (*git.Repository, error) {
+	r, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		r, err = git.PlainClone(dir, true, &git.CloneOptions{URL: url})
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if _, err := r.CommitObject(plumbing.NewHash(hash)); err == nil {
+		return r, nil
+	}
+
+	var refSpecs = []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+	if ref != "" {
+		refSpecs = append(refSpecs, config.RefSpec("+"+ref+":"+ref))
+	}
+
+	err = r.Fetch(&git.FetchOptions{RefSpecs: refSpecs, Force: true})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// checkoutWorktree checks out the given hash in the given directory, using
+// the objects of the given storage. The index and HEAD of the worktree are
+// kept in memory, so the storage is not modified.
+func checkoutWorktree(s storage.Storer, dir, hash string) error {
+	ws := &worktreeStorer{Storer: s, refs: memory.ReferenceStorage{}}
+	ws.refs.SetReference(plumbing.NewHashReference(plumbing.HEAD, plumbing.NewHash(hash)))
+
+	r, err := git.Open(ws, osfs.New(dir))
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return w.Checkout(&git.CheckoutOptions{
+		Hash:  plumbing.NewHash(hash),
+		Force: true,
 	})
+}
+
+// worktreeStorer is the storage of a worktree of a shared bare repository,
+// with its own index and HEAD.
+type worktreeStorer struct {
+	storage.Storer
+	index memory.IndexStorage
+	refs  memory.ReferenceStorage
+}
+
+func (s *worktreeStorer) SetIndex(idx *index.Index) error {
+	return s.index.SetIndex(idx)
+}
+
+func (s *worktreeStorer) Index() (*index.Index, error) {
+	return s.index.Index()
+}
+
+func (s *worktreeStorer) SetReference(ref *plumbing.Reference) error {
+	if ref.Name() == plumbing.HEAD {
+		return s.refs.SetReference(ref)
+	}
+	return s.Storer.SetReference(ref)
+}
+
+func (s *worktreeStorer) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	if ref.Name() == plumbing.HEAD {
+		return s.refs.CheckAndSetReference(ref, old)
+	}
+	return s.Storer.CheckAndSetReference(ref, old)
+}
+
+func (s *worktreeStorer) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if name == plumbing.HEAD {
+		return s.refs.Reference(name)
+	}
+	return s.Storer.Reference(name)
+}
+
+// acquire marks the clone in the given directory as in use, so it is not
+// evicted.
+func (c *CloneCache) acquire(repoDir string) *cachedRepo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	repo, ok := c.repos[repoDir]
+	if !ok {
+		repo = new(cachedRepo)
+		c.repos[repoDir] = repo
+	}
+	repo.users++
+	return repo
+}
+
+// release marks the clone in the given directory as not in use by one of
+// its users, and evicts the clones that exceed the limits of the cache.
+func (c *CloneCache) release(repoDir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.repos[repoDir].users--
+	c.evict()
+}
+
+// evict removes the clones that were not used for longer than the maximum
+// age, and then the least recently used ones until the cache is not bigger
+// than its maximum size, according to the sizes of the clones when they
+// were last fetched. Clones in use are never removed. It must be called
+// with the lock of the cache held.
+func (c *CloneCache) evict() {
+	infos, err := ioutil.ReadDir(filepath.Join(c.dir, "repos"))
 	if err != nil {
-		return "", err
+		return
 	}
-	return tmp, nil
+
+	// Least recently used first.
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	var total int64
+	for _, repo := range c.repos {
+		total += repo.size
+	}
+
+	for _, info := range infos {
+		dir := filepath.Join(c.dir, "repos", info.Name())
+		repo, ok := c.repos[dir]
+		if !ok || repo.users > 0 {
+			continue
+		}
+
+		expired := c.maxAge > 0 && time.Since(info.ModTime()) > c.maxAge
+		tooBig := c.maxSize > 0 && total > c.maxSize
+		if !expired && !tooBig {
+			continue
+		}
+
+		if err := os.RemoveAll(dir); err != nil {
+			continue
+		}
+		delete(c.repos, dir)
+		total -= repo.size
+	}
+}
+
+// dirSize returns the total size of the files in the given directory.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
 }
@@ -0,0 +1,145 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func TestCloneCache(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	src := filepath.Join(tmp, "s", "rc")
+	gitIn := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "init.defaultBranch=main"}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		require.NoError(err, string(out))
+		return strings.TrimSpace(string(out))
+	}
+	git := func(args ...string) string {
+		return gitIn(src, args...)
+	}
+
+	writeFiles(t, src, map[string]string{"a.go": "package a\n"})
+	git("init")
+	git("add", ".")
+	git("commit", "-m", "first")
+	first := git("rev-parse", "HEAD")
+
+	cache, err := NewCloneCache(filepath.Join(tmp, "cache"), 0, 0)
+	require.NoError(err)
+
+	// The default branch is known without checking anything out.
+	isDefault, err := cache.IsDefault(src, first, plumbing.ReferenceName("refs/heads/main"))
+	require.NoError(err)
+	require.True(isDefault)
+	worktrees, err := ioutil.ReadDir(filepath.Join(tmp, "cache", "worktrees"))
+	require.NoError(err)
+	require.Len(worktrees, 0)
+
+	dir, release, err := cache.Checkout(src, first, plumbing.ReferenceName("refs/heads/main"))
+	require.NoError(err)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "a.go"))
+	require.NoError(err)
+	require.Equal("package a\n", string(content))
+
+	git("checkout", "-b", "other")
+	writeFiles(t, src, map[string]string{"a.go": "package b\n"})
+	git("commit", "-am", "second")
+	second := git("rev-parse", "HEAD")
+
+	// The new commit is fetched into the existing clone, and both
+	// revisions can be checked out at the same time.
+	isDefault, err = cache.IsDefault(src, second, plumbing.ReferenceName("refs/heads/other"))
+	require.NoError(err)
+	require.False(isDefault)
+
+	dir2, release2, err := cache.Checkout(src, second, plumbing.ReferenceName("refs/heads/other"))
+	require.NoError(err)
+	require.NotEqual(dir, dir2)
+	content, err = ioutil.ReadFile(filepath.Join(dir2, "a.go"))
+	require.NoError(err)
+	require.Equal("package b\n", string(content))
+
+	release()
+	_, err = os.Stat(dir)
+	require.True(os.IsNotExist(err))
+	release2()
+
+	repos, err := ioutil.ReadDir(filepath.Join(tmp, "cache", "repos"))
+	require.NoError(err)
+	require.Len(repos, 1)
+
+	// Repositories whose URLs have the same report name have their own
+	// clone.
+	clash := filepath.Join(tmp, "s_rc")
+	require.Equal(reportName(src), reportName(clash))
+	writeFiles(t, clash, map[string]string{"a.go": "package c\n"})
+	gitIn(clash, "init")
+	gitIn(clash, "add", ".")
+	gitIn(clash, "commit", "-m", "clash")
+
+	dir, release, err = cache.Checkout(clash, gitIn(clash, "rev-parse", "HEAD"), "")
+	require.NoError(err)
+	content, err = ioutil.ReadFile(filepath.Join(dir, "a.go"))
+	require.NoError(err)
+	require.Equal("package c\n", string(content))
+	release()
+
+	repos, err = ioutil.ReadDir(filepath.Join(tmp, "cache", "repos"))
+	require.NoError(err)
+	require.Len(repos, 2)
+
+	// The sizes of the clones are tracked when they are fetched, and the
+	// ones of the existing clones when the cache is created, so they are
+	// not computed again on every eviction.
+	srcSize := dirSize(cache.repoDir(src))
+	require.Equal(srcSize, cache.repos[cache.repoDir(src)].size)
+	require.Equal(dirSize(cache.repoDir(clash)), cache.repos[cache.repoDir(clash)].size)
+
+	cache, err = NewCloneCache(filepath.Join(tmp, "cache"), srcSize, 0)
+	require.NoError(err)
+	require.Equal(srcSize, cache.repos[cache.repoDir(src)].size)
+
+	// The least recently used clones are evicted while the cache is too
+	// big.
+	_, release, err = cache.Checkout(src, second, "")
+	require.NoError(err)
+	release()
+
+	repos, err = ioutil.ReadDir(filepath.Join(tmp, "cache", "repos"))
+	require.NoError(err)
+	require.Len(repos, 1)
+	require.Equal(filepath.Base(cache.repoDir(src)), repos[0].Name())
+
+	// Clones that exceed the limits are evicted once they are not in use.
+	cache, err = NewCloneCache(filepath.Join(tmp, "cache"), 0, time.Nanosecond)
+	require.NoError(err)
+
+	_, release, err = cache.Checkout(src, second, "")
+	require.NoError(err)
+	time.Sleep(time.Millisecond)
+	release()
+
+	repos, err = ioutil.ReadDir(filepath.Join(tmp, "cache", "repos"))
+	require.NoError(err)
+	require.Len(repos, 0)
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mloncode/memlayout"
 	"google.golang.org/grpc"
@@ -17,16 +20,68 @@ const (
 	defaultPort       = 3455
 	defaultDataServer = "localhost:10301"
 	maxMessageSize    = 100 * 1024 * 1024 // 100mb
+	defaultCacheSize  = 2048              // 2gb
+	defaultCacheAge   = 7 * 24 * time.Hour
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verify(os.Args[2:]))
+	}
+
 	var port uint
 	var dataServer string
+	var archs string
+	var ptrData bool
+	var sizeClassOnly bool
+	var hot string
+	var builds string
+	var reportDir string
+	var cacheDir string
+	var cacheSize int64
+	var cacheAge time.Duration
 
 	flag.UintVar(&port, "port", defaultPort, "port the server will bind to")
 	flag.StringVar(&dataServer, "data-server", defaultDataServer, "address of the lookout data server")
+	flag.StringVar(&archs, "archs", strings.Join(memlayout.DefaultArchs, ","), "comma-separated list of target architectures")
+	flag.BoolVar(&ptrData, "ptrdata", false, "also suggest layouts that reduce the memory scanned by the garbage collector")
+	flag.BoolVar(&sizeClassOnly, "size-class-only", false, "only suggest layouts that reduce the memory actually allocated")
+	flag.StringVar(&hot, "hot", "", "comma-separated list of hot fields to keep in the first cache lines, as Struct.Field")
+	flag.StringVar(&builds, "builds", "", "space-separated list of build configurations to analyze, as GOOS/GOARCH[:tag,tag...]")
+	flag.StringVar(&reportDir, "report-dir", "", "directory the reports of the audits on pushes to the default branch are written to")
+	flag.StringVar(&cacheDir, "cache-dir", filepath.Join(os.TempDir(), "memlayout-cache"), "directory the repositories are cloned in")
+	flag.Int64Var(&cacheSize, "cache-size", defaultCacheSize, "maximum size of the cloned repositories in MB, or 0 for no limit")
+	flag.DurationVar(&cacheAge, "cache-age", defaultCacheAge, "time after which unused cloned repositories are removed, or 0 to keep them")
 	flag.Parse()
 
+	config := memlayout.Config{
+		Archs:         strings.Split(archs, ","),
+		PtrData:       ptrData,
+		SizeClassOnly: sizeClassOnly,
+		ReportDir:     reportDir,
+	}
+	if hot != "" {
+		config.Hot = strings.Split(hot, ",")
+	}
+	for _, b := range strings.Fields(builds) {
+		build, err := memlayout.ParseBuild(b)
+		if err != nil {
+			log.Errorf(err, "invalid build configuration")
+			os.Exit(1)
+		}
+		config.Builds = append(config.Builds, build)
+	}
+	if err := memlayout.ValidateArchs(config.Archs); err != nil {
+		log.Errorf(err, "invalid target architectures")
+		os.Exit(1)
+	}
+
+	cache, err := memlayout.NewCloneCache(cacheDir, cacheSize*1024*1024, cacheAge)
+	if err != nil {
+		log.Errorf(err, "unable to create clone cache in %s", cacheDir)
+		os.Exit(1)
+	}
+
 	l, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", port))
 	if err != nil {
 		log.Errorf(err, "failed to listen on port: %d", port)
@@ -39,7 +94,7 @@ func main() {
 	}
 
 	s := grpc.NewServer(opts...)
-	lookout.RegisterAnalyzerServer(s, memlayout.NewAnalyzer(version, dataServer))
+	lookout.RegisterAnalyzerServer(s, memlayout.NewAnalyzer(version, dataServer, config, cache))
 	log.Infof("starting gRPC Analyzer server at port %d", port)
 	s.Serve(l)
 }
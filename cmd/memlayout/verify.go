@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/mloncode/memlayout"
+	"gopkg.in/src-d/go-log.v1"
+)
+
+// verify compares the layout memlayout computes for the structs of the
+// files in the given arguments with the one of the compiler, and returns
+// the exit code of the command.
+func verify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	archs := flags.String("archs", strings.Join(memlayout.DefaultArchs, ","), "comma-separated list of target architectures")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: memlayout verify [-archs=arch,...] file.go...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	targets := strings.Split(*archs, ",")
+	if err := memlayout.ValidateArchs(targets); err != nil {
+		log.Errorf(err, "invalid target architectures")
+		return 2
+	}
+
+	session := memlayout.NewSession(0)
+	var failed bool
+	for _, file := range flags.Args() {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Errorf(err, "unable to read %s", file)
+			failed = true
+			continue
+		}
+
+		mismatches, err := session.Verify(file, content, targets)
+		if err != nil {
+			log.Errorf(err, "unable to verify %s", file)
+			failed = true
+			continue
+		}
+
+		for _, m := range mismatches {
+			fmt.Fprintf(os.Stdout, "%s: %s\n", file, m)
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,282 @@
+package memlayout
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gogo/protobuf/types"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigFile is the name of the file in the root of a repository with the
+// configuration of the analyzer for that repository.
+const ConfigFile = ".memlayout.yml"
+
+// Comment styles.
+const (
+	// CommentStyleFull comments include the layout of the struct, its
+	// sizes and cache lines, and the padding holes.
+	CommentStyleFull = "full"
+	// CommentStyleCompact comments only include the proposed layout.
+	CommentStyleCompact = "compact"
+)
+
+// repoConfig is the configuration of the analyzer for a repository, as
+// given in the configuration of an event or in the ConfigFile. Fields that
+// are not set do not change the configuration they are applied to.
+type repoConfig struct {
+	Archs         []string `yaml:"archs"`
+	PtrData       *bool    `yaml:"ptrdata"`
+	SizeClassOnly *bool    `yaml:"size_class_only"`
+	Hot           []string `yaml:"hot"`
+	MinBytes      *int64   `yaml:"min_bytes"`
+	MinPercent    *float64 `yaml:"min_percent"`
+	Include       []string `yaml:"include"`
+	Exclude       []string `yaml:"exclude"`
+	IgnoreStructs []string `yaml:"ignore_structs"`
+	CommentStyle  *string  `yaml:"comment_style"`
+	// Overrides are the configurations of the paths of the repository
+	// matching their patterns. Later overrides take precedence.
+	Overrides []override `yaml:"overrides"`
+}
+
+// override is the configuration of the paths matching a pattern.
+type override struct {
+	Path       string `yaml:"path"`
+	repoConfig `yaml:",inline"`
+}
+
+// apply sets the fields of the config that are set in the repository
+// config. Overrides are added to the ones of the config.
+func (r repoConfig) apply(c Config) Config {
+	if r.Archs != nil {
+		c.Archs = r.Archs
+	}
+	if r.PtrData != nil {
+		c.PtrData = *r.PtrData
+	}
+	if r.SizeClassOnly != nil {
+		c.SizeClassOnly = *r.SizeClassOnly
+	}
+	if r.Hot != nil {
+		c.Hot = r.Hot
+	}
+	if r.MinBytes != nil {
+		c.MinBytes = *r.MinBytes
+	}
+	if r.MinPercent != nil {
+		c.MinPercent = *r.MinPercent
+	}
+	if r.Include != nil {
+		c.Include = r.Include
+	}
+	if r.Exclude != nil {
+		c.Exclude = r.Exclude
+	}
+	if r.IgnoreStructs != nil {
+		c.IgnoreStructs = r.IgnoreStructs
+	}
+	if r.CommentStyle != nil {
+		c.CommentStyle = *r.CommentStyle
+	}
+	if len(r.Overrides) > 0 {
+		c.overrides = append(append([]override(nil), c.overrides...), r.Overrides...)
+	}
+	return c
+}
+
+// validate returns an error if any of the values of the config is not
+// valid.
+func (r repoConfig) validate() error {
+	if r.Archs != nil {
+		if err := ValidateArchs(r.Archs); err != nil {
+			return err
+		}
+	}
+
+	if r.CommentStyle != nil {
+		switch *r.CommentStyle {
+		case CommentStyleFull, CommentStyleCompact:
+		default:
+			return fmt.Errorf("unknown comment style %q", *r.CommentStyle)
+		}
+	}
+
+	var patterns []string
+	patterns = append(patterns, r.Include...)
+	patterns = append(patterns, r.Exclude...)
+	patterns = append(patterns, r.IgnoreStructs...)
+	for _, o := range r.Overrides {
+		if o.Path == "" {
+			return fmt.Errorf("override without path")
+		}
+		if len(o.Overrides) > 0 {
+			return fmt.Errorf("override of %q cannot have overrides", o.Path)
+		}
+		if err := o.repoConfig.validate(); err != nil {
+			return fmt.Errorf("override of %q: %s", o.Path, err)
+		}
+		patterns = append(patterns, o.Path)
+	}
+
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+	}
+
+	return nil
+}
+
+// ConfigFor returns the config of the analyzer for a repository, which is
+// the given config with the configuration of the event applied, and then
+// the given content of the ConfigFile of the repository, if any.
+func ConfigFor(config Config, event types.Struct, file []byte) (Config, error) {
+	var fromEvent repoConfig
+	if len(event.Fields) > 0 {
+		data, err := yaml.Marshal(structValue(&event))
+		if err != nil {
+			return config, err
+		}
+
+		if err := parseConfig(data, &fromEvent); err != nil {
+			return config, fmt.Errorf("invalid event configuration: %s", err)
+		}
+	}
+	config = fromEvent.apply(config)
+
+	if file == nil {
+		return config, nil
+	}
+
+	var fromFile repoConfig
+	if err := parseConfig(file, &fromFile); err != nil {
+		return config, fmt.Errorf("invalid %s: %s", ConfigFile, err)
+	}
+
+	return fromFile.apply(config), nil
+}
+
+func parseConfig(data []byte, r *repoConfig) error {
+	if err := yaml.UnmarshalStrict(data, r); err != nil {
+		return err
+	}
+	return r.validate()
+}
+
+// structValue returns the given protobuf struct as a map.
+func structValue(s *types.Struct) map[string]interface{} {
+	var result = make(map[string]interface{}, len(s.Fields))
+	for k, v := range s.Fields {
+		result[k] = value(v)
+	}
+	return result
+}
+
+// value returns the Go value of the given protobuf value.
+func value(v *types.Value) interface{} {
+	switch k := v.GetKind().(type) {
+	case *types.Value_NumberValue:
+		return k.NumberValue
+	case *types.Value_StringValue:
+		return k.StringValue
+	case *types.Value_BoolValue:
+		return k.BoolValue
+	case *types.Value_StructValue:
+		return structValue(k.StructValue)
+	case *types.Value_ListValue:
+		var result = make([]interface{}, 0, len(k.ListValue.Values))
+		for _, v := range k.ListValue.Values {
+			result = append(result, value(v))
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+// forPath returns the config for the file with the given path, relative to
+// the root of the repository, with the overrides matching it applied.
+func (c Config) forPath(p string) Config {
+	p = filepath.ToSlash(p)
+	for _, o := range c.overrides {
+		if matchPath(o.Path, p) {
+			c = o.repoConfig.apply(c)
+		}
+	}
+	return c
+}
+
+// analyzes reports whether the file with the given path, relative to the
+// root of the repository, is analyzed.
+func (c Config) analyzes(p string) bool {
+	p = filepath.ToSlash(p)
+	if len(c.Include) > 0 && !matchAny(c.Include, p) {
+		return false
+	}
+	return !matchAny(c.Exclude, p)
+}
+
+// ignores reports whether the struct is excluded from the analysis by the
+// config or by a directive.
+func (c Config) ignores(s Struct) bool {
+	if s.Ignore {
+		return true
+	}
+
+	name := s.Name
+	if s.Generic != "" {
+		name = s.Generic
+	}
+
+	for _, pattern := range c.IgnoreStructs {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// worthSaving reports whether saving the given number of bytes of a struct
+// of the given size is worth suggesting according to the thresholds of
+// the config.
+func (c Config) worthSaving(size, saved int64) bool {
+	if c.MinBytes > 0 && saved < c.MinBytes {
+		return false
+	}
+	if c.MinPercent > 0 && float64(saved)*100 < c.MinPercent*float64(size) {
+		return false
+	}
+	return true
+}
+
+func (c Config) compact() bool {
+	return c.CommentStyle == CommentStyleCompact
+}
+
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPath reports whether the slash-separated path, or any of its parent
+// directories, matches the given pattern.
+func matchPath(pattern, p string) bool {
+	for {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
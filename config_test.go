@@ -0,0 +1,71 @@
+package memlayout
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/stretchr/testify/require"
+)
+
+const configFileSource = `
+min_bytes: 8
+exclude:
+  - "gen/*"
+ignore_structs:
+  - "*Proto"
+overrides:
+  - path: "internal/hot"
+    min_bytes: 1
+    archs: [amd64, "386"]
+`
+
+func TestConfigFor(t *testing.T) {
+	require := require.New(t)
+
+	event := types.Struct{Fields: map[string]*types.Value{
+		"min_bytes":     {Kind: &types.Value_NumberValue{NumberValue: 4}},
+		"min_percent":   {Kind: &types.Value_NumberValue{NumberValue: 10}},
+		"comment_style": {Kind: &types.Value_StringValue{StringValue: CommentStyleCompact}},
+	}}
+
+	config, err := ConfigFor(Config{Archs: []string{"amd64"}}, event, nil)
+	require.NoError(err)
+	require.Equal(int64(4), config.MinBytes)
+	require.Equal(float64(10), config.MinPercent)
+	require.True(config.compact())
+
+	config, err = ConfigFor(Config{Archs: []string{"amd64"}}, event, []byte(configFileSource))
+	require.NoError(err)
+	require.Equal(int64(8), config.MinBytes)
+	require.Equal(float64(10), config.MinPercent)
+	require.Equal([]string{"amd64"}, config.Archs)
+
+	require.True(config.analyzes("foo/foo.go"))
+	require.False(config.analyzes("gen/foo.go"))
+	require.False(config.analyzes("gen/sub/foo.go"))
+
+	require.True(config.ignores(Struct{Name: "FooProto"}))
+	require.True(config.ignores(Struct{Name: "Foo", Ignore: true}))
+	require.False(config.ignores(Struct{Name: "Foo"}))
+
+	require.False(config.worthSaving(64, 4))
+	require.True(config.worthSaving(64, 8))
+	require.False(config.worthSaving(128, 8))
+
+	hot := config.forPath("internal/hot/cache.go")
+	require.Equal(int64(1), hot.MinBytes)
+	require.Equal([]string{"amd64", "386"}, hot.Archs)
+	require.Equal(float64(10), hot.MinPercent)
+	require.Equal(int64(8), config.forPath("internal/cold/cache.go").MinBytes)
+
+	for _, invalid := range []string{
+		"unknown: true\n",
+		"archs: [pdp11]\n",
+		"comment_style: verbose\n",
+		"exclude: [\"[\"]\n",
+		"overrides:\n  - min_bytes: 1\n",
+	} {
+		_, err = ConfigFor(Config{}, types.Struct{}, []byte(invalid))
+		require.Error(err, invalid)
+	}
+}
@@ -1,9 +1,11 @@
 package memlayout
 
 import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"strings"
-
-	"github.com/sergi/go-diff/diffmatchpatch"
 )
 
 // ChangedStruct contains a struct that was changed in a diff with its previous
@@ -15,48 +17,256 @@ type ChangedStruct struct {
 	Head Struct
 }
 
-// ChangedStructs returns all the changed structs in the diff.
+// ChangedStructs returns the structs of the head revision whose
+// declaration changed in the diff, that is, whose fields, their types or
+// their order are different in the base revision, or that did not exist
+// in it. Changes in comments or in the rest of the file are ignored.
 func ChangedStructs(
 	base, head []byte,
 	structs []Struct,
 ) []Struct {
-	lines := changedLines(base, head)
+	headDecls, err := structDecls(head)
+	if err != nil {
+		return structs
+	}
+
+	// If the base revision cannot be parsed, every struct is changed.
+	baseDecls, _ := structDecls(base)
+	var before = make(map[string]map[string]bool)
+	for _, d := range baseDecls {
+		if before[d.name] == nil {
+			before[d.name] = make(map[string]bool)
+		}
+		before[d.name][d.def] = true
+	}
 
 	var result []Struct
 	for _, s := range structs {
-		for _, l := range lines {
-			if l >= s.Start && l <= s.End {
-				result = append(result, s)
+		name := s.Name
+		if s.Generic != "" {
+			name = s.Generic
+		}
+
+		changed := true
+		for _, d := range headDecls {
+			if d.name == name && d.pos == s.Pos {
+				changed = !before[name][d.def]
 				break
 			}
 		}
+
+		if changed {
+			result = append(result, s)
+		}
 	}
 
 	return result
 }
 
-func changedLines(base, head []byte) []int {
-	dmp := diffmatchpatch.New()
-	diff := dmp.DiffMain(string(base), string(head), false)
+// structDecl is the declaration of a struct in a file.
+type structDecl struct {
+	name string
+	pos  Pos
+	// def is the definition of the struct, with the names and types of its
+	// fields in order.
+	def string
+}
 
-	var acc int
-	var result []int
+// structDecls returns the declarations of all the structs in the file with
+// the given content, named the same way StructsFromFile does.
+func structDecls(content []byte) ([]structDecl, error) {
+	if len(content) == 0 {
+		return nil, nil
+	}
 
-	for _, d := range diff {
-		lines := len(strings.Split(d.Text, "\n"))
-		if d.Type == diffmatchpatch.DiffDelete {
-			result = append(result, acc)
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", content, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []structDecl
+	for _, d := range f.Decls {
+		gd, ok := d.(*ast.GenDecl)
+		if !ok {
 			continue
 		}
 
-		if d.Type == diffmatchpatch.DiffInsert {
-			for i := 1; i <= lines; i++ {
-				result = append(result, acc+i)
+		for _, spec := range gd.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok {
+				continue
+			}
+
+			if st, ok := ts.Type.(*ast.StructType); ok {
+				result = append(result, structDecl{
+					name: ts.Name.Name,
+					pos:  posOf(fset, ts),
+					def:  structDef(ts.TypeParams, st),
+				})
+			}
+		}
+	}
+
+	for _, local := range localStructs(f) {
+		var n ast.Node = local.st
+		if local.spec != nil {
+			n = local.spec
+		}
+
+		result = append(result, structDecl{
+			name: local.name,
+			pos:  posOf(fset, n),
+			def:  structDef(nil, local.st),
+		})
+	}
+
+	return result, nil
+}
+
+// structDef returns the definition of a struct type with the given type
+// parameters, if any, in a canonical form that does not depend on
+// formatting or comments.
+func structDef(params *ast.FieldList, st *ast.StructType) string {
+	var tparams []string
+	if params != nil {
+		for _, p := range params.List {
+			var names []string
+			for _, n := range p.Names {
+				names = append(names, n.Name)
 			}
+			tparams = append(tparams, strings.Join(names, ", ")+" "+types.ExprString(p.Type))
 		}
+	}
+
+	def := types.ExprString(st)
+	if len(tparams) > 0 {
+		def = "[" + strings.Join(tparams, "; ") + "]" + def
+	}
+	return def
+}
 
-		acc += lines
+// PairChanged pairs every changed struct from the head revision with the
+// struct with the same name in the given structs from the base revision,
+// if any.
+func PairChanged(base, changed []Struct) []ChangedStruct {
+	var result = make([]ChangedStruct, len(changed))
+	for i, head := range changed {
+		result[i].Head = head
+		for j := range base {
+			if base[j].Name == head.Name {
+				result[i].Base = &base[j]
+				break
+			}
+		}
 	}
+	return result
+}
+
+// minSimilarity is the minimum similarity between the fields of two
+// structs for one of them to be considered a moved or renamed version of
+// the other.
+const minSimilarity = 0.6
+
+// MatchMoved pairs the changed structs without a base version with the
+// most similar of the given structs removed from the base revision, so
+// structs that were moved to another file or renamed keep their history.
+// Structs are similar if they have mostly the same fields, regardless of
+// their order. Every removed struct is paired at most once.
+func MatchMoved(changed []ChangedStruct, removed []Struct) []ChangedStruct {
+	result := make([]ChangedStruct, len(changed))
+	copy(result, changed)
 
+	used := make([]bool, len(removed))
+	for i := range result {
+		if result[i].Base != nil {
+			continue
+		}
+
+		var best = -1
+		var bestSimilarity float64
+		for j := range removed {
+			if used[j] {
+				continue
+			}
+
+			s := similarity(removed[j], result[i].Head)
+			if s >= minSimilarity && s > bestSimilarity {
+				best, bestSimilarity = j, s
+			}
+		}
+
+		if best >= 0 {
+			used[best] = true
+			result[i].Base = &removed[best]
+		}
+	}
+
+	return result
+}
+
+// similarity returns the proportion of the fields of both structs that
+// they have in common, from 0 to 1.
+func similarity(a, b Struct) float64 {
+	fields := make(map[string]int)
+	for _, k := range fieldKeys(a) {
+		fields[k]++
+	}
+
+	var common, total int
+	for _, k := range fieldKeys(b) {
+		if fields[k] > 0 {
+			fields[k]--
+			common++
+		} else {
+			total++
+		}
+	}
+
+	for _, n := range fields {
+		total += n
+	}
+	total += common
+
+	if total == 0 {
+		return 0
+	}
+	return float64(common) / float64(total)
+}
+
+// SameLayout reports whether both structs have the same fields, with the
+// same types, in the same order.
+func SameLayout(a, b Struct) bool {
+	ka, kb := fieldKeys(a), fieldKeys(b)
+	if len(ka) != len(kb) {
+		return false
+	}
+
+	for i := range ka {
+		if ka[i] != kb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldKeys returns the name and type of every field of the struct, with
+// types qualified by package name, so they do not change when the struct
+// is moved to another package.
+func fieldKeys(s Struct) []string {
+	var result []string
+	for _, f := range s.Fields {
+		if f.IsPadding {
+			continue
+		}
+
+		typ := f.Type
+		if f.field != nil {
+			typ = types.TypeString(f.field.Type(), func(p *types.Package) string {
+				return p.Name()
+			})
+		}
+		result = append(result, f.Name+" "+typ)
+	}
 	return result
 }
@@ -66,7 +66,7 @@ func TestChangedStructs(t *testing.T) {
 				f("A", "int", 0, 8, 8, 8, false),
 				f("B", "bool", 8, 9, 1, 1, false),
 				f("", "", 9, 16, 7, 0, true),
-				f("F", "*string", 16, 24, 8, 8, false),
+				withPtrData(f("F", "*string", 16, 24, 8, 8, false), 8),
 			},
 		},
 	}
@@ -76,3 +76,183 @@ func TestChangedStructs(t *testing.T) {
 		structsEqual(t, expected[i], changed[i])
 	}
 }
+
+func TestPairChanged(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(testSourceHead), 0755))
+
+	head, err := StructsFromFile(path, []byte(testSourceHead))
+	require.NoError(err)
+
+	base, err := StructsFromFile(path, []byte(testSource))
+	require.NoError(err)
+
+	changed := ChangedStructs([]byte(testSource), []byte(testSourceHead), head)
+	pairs := PairChanged(base, changed)
+	require.Len(pairs, 2)
+
+	require.Equal("Mux", pairs[0].Head.Name)
+	require.Nil(pairs[0].Base)
+
+	require.Equal("Qux", pairs[1].Head.Name)
+	require.NotNil(pairs[1].Base)
+	require.Equal("Qux", pairs[1].Base.Name)
+	require.Equal(int64(56), pairs[1].Base.Size())
+	require.Equal(int64(24), pairs[1].Head.Size())
+	require.False(HasBetterAlignment(*pairs[1].Base, pairs[1].Head))
+}
+
+func TestChangedStructsIgnoresOtherEdits(t *testing.T) {
+	require := require.New(t)
+
+	const base = `
+package main
+
+type Foo struct {
+	A int
+	B bool
+}
+
+type Bar struct {
+	A int
+	B bool
+}
+
+func run() {
+	var x struct {
+		A bool
+	}
+	_ = x
+}
+`
+
+	const head = `
+package main
+
+// Something new in the file.
+func Qux() int { return 1 }
+
+type Foo struct {
+	// A is documented now.
+	A int
+	B bool
+}
+
+type Bar struct {
+	B bool
+	A int
+}
+
+func run() {
+	var x struct {
+		A bool
+		B int
+	}
+	_ = x
+}
+`
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(head), 0755))
+
+	structs, err := StructsFromFile(path, []byte(head))
+	require.NoError(err)
+	require.Len(structs, 3)
+
+	var names []string
+	for _, s := range ChangedStructs([]byte(base), []byte(head), structs) {
+		names = append(names, s.Name)
+	}
+	require.Equal([]string{"Bar", "run.x"}, names)
+
+	require.Len(ChangedStructs([]byte(head), []byte(head), structs), 0)
+	require.Len(ChangedStructs(nil, []byte(head), structs), 3)
+}
+
+func TestMatchMoved(t *testing.T) {
+	require := require.New(t)
+
+	const base = `
+package foo
+
+type Foo struct {
+	A int
+	B bool
+	C string
+}
+
+type Old struct {
+	X int
+	Y int
+}
+`
+
+	const head = `
+package foo
+
+type Other struct {
+	P string
+}
+
+type Bar struct {
+	A int
+	B bool
+	C string
+}
+
+type New struct {
+	X int
+	Y int
+	Z bool
+}
+`
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(base), 0755))
+
+	removed, err := StructsFromFile(path, []byte(base))
+	require.NoError(err)
+
+	require.NoError(ioutil.WriteFile(path, []byte(head), 0755))
+	structs, err := StructsFromFile(path, []byte(head))
+	require.NoError(err)
+
+	var changed []ChangedStruct
+	for _, s := range structs {
+		changed = append(changed, ChangedStruct{Head: s})
+	}
+
+	matched := MatchMoved(changed, removed)
+	require.Len(matched, 3)
+
+	require.Equal("Bar", matched[0].Head.Name)
+	require.Equal("Foo", matched[0].Base.Name)
+	require.True(SameLayout(*matched[0].Base, matched[0].Head))
+
+	require.Equal("New", matched[1].Head.Name)
+	require.Equal("Old", matched[1].Base.Name)
+	require.False(SameLayout(*matched[1].Base, matched[1].Head))
+
+	require.Equal("Other", matched[2].Head.Name)
+	require.Nil(matched[2].Base)
+}
@@ -0,0 +1,143 @@
+package memlayout
+
+import (
+	"go/ast"
+	"go/types"
+	"strings"
+)
+
+const directivePrefix = "//memlayout:"
+
+// Directives that can be used in the doc comment of a struct.
+const (
+	// IgnoreDirective excludes a struct from the analysis.
+	IgnoreDirective = "ignore"
+	// KeepOrderDirective marks a struct whose field order is meaningful, so
+	// it is never reordered.
+	KeepOrderDirective = "keep-order"
+)
+
+// Directives that can be used in the doc or line comment of a field.
+const (
+	// FirstDirective pins a field to the beginning of the struct.
+	FirstDirective = "first"
+	// LastDirective pins a field to the end of the struct.
+	LastDirective = "last"
+	// HotDirective marks a field as frequently accessed, so it is kept in
+	// the first cache lines of the struct.
+	HotDirective = "hot"
+)
+
+// Pin is the position a field is pinned to when the struct is optimized.
+type Pin int
+
+const (
+	// NotPinned fields can be moved anywhere.
+	NotPinned Pin = iota
+	// PinnedFirst fields are kept at the beginning of the struct, in their
+	// declaration order.
+	PinnedFirst
+	// PinnedLast fields are kept at the end of the struct, in their
+	// declaration order.
+	PinnedLast
+)
+
+func (p Pin) rank() int {
+	switch p {
+	case PinnedFirst:
+		return 0
+	case PinnedLast:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// directives returns the memlayout directives in the given comment groups.
+func directives(groups ...*ast.CommentGroup) map[string]bool {
+	result := make(map[string]bool)
+	for _, g := range groups {
+		if g == nil {
+			continue
+		}
+
+		for _, c := range g.List {
+			if !strings.HasPrefix(c.Text, directivePrefix) {
+				continue
+			}
+
+			fields := strings.Fields(strings.TrimPrefix(c.Text, directivePrefix))
+			if len(fields) > 0 {
+				result[fields[0]] = true
+			}
+		}
+	}
+	return result
+}
+
+// specDocs returns the doc comments of a spec in the given declaration.
+// The doc comment of the declaration only applies to the spec if it is the
+// only one in it.
+func specDocs(decl *ast.GenDecl, doc *ast.CommentGroup) []*ast.CommentGroup {
+	var groups = []*ast.CommentGroup{doc}
+	if len(decl.Specs) == 1 {
+		groups = append(groups, decl.Doc)
+	}
+	return groups
+}
+
+// applyStructDirectives sets the options of the struct according to the
+// directives in the given doc comments of its declaration and its marker
+// fields.
+func applyStructDirectives(s *Struct, docs []*ast.CommentGroup) {
+	d := directives(docs...)
+	s.Ignore = d[IgnoreDirective]
+	s.KeepOrder = d[KeepOrderDirective]
+
+	for i, f := range s.Fields {
+		if f.IsPadding {
+			continue
+		}
+
+		if isHostLayout(f.field.Type()) {
+			s.KeepOrder = true
+		}
+
+		if isNoCopy(f.field.Type()) {
+			s.Fields[i].Pin = PinnedFirst
+		}
+
+		if f.node == nil {
+			continue
+		}
+
+		d := directives(f.node.field.Doc, f.node.field.Comment)
+		switch {
+		case d[FirstDirective]:
+			s.Fields[i].Pin = PinnedFirst
+		case d[LastDirective]:
+			s.Fields[i].Pin = PinnedLast
+		}
+		s.Fields[i].Hot = d[HotDirective]
+	}
+}
+
+// isHostLayout reports whether the type is structs.HostLayout, which
+// marks structs that must follow the host platform layout.
+func isHostLayout(typ types.Type) bool {
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return false
+	}
+
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "structs" &&
+		obj.Name() == "HostLayout"
+}
+
+// isNoCopy reports whether the type is a noCopy marker used by go vet to
+// detect copies of the struct.
+func isNoCopy(typ types.Type) bool {
+	named, ok := typ.(*types.Named)
+	return ok && named.Obj().Name() == "noCopy"
+}
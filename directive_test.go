@@ -0,0 +1,86 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const directivesSource = `
+package foo
+
+import "structs"
+
+//memlayout:ignore
+type Ignored struct {
+	A bool
+	B int64
+}
+
+// Ordered is sent over the wire.
+//memlayout:keep-order
+type Ordered struct {
+	A bool
+	B int64
+}
+
+type Host struct {
+	_ structs.HostLayout
+	A bool
+	B int64
+}
+
+type noCopy struct{}
+
+type Pinned struct {
+	A bool
+	B int64
+	//memlayout:first
+	C bool
+	D int32 //memlayout:last
+	E int16
+	_ noCopy
+}
+`
+
+func TestDirectives(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(directivesSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(directivesSource))
+	require.NoError(err)
+
+	byName := make(map[string]Struct)
+	for _, s := range structs {
+		byName[s.Name] = s
+	}
+
+	require.True(byName["Ignored"].Ignore)
+	require.False(byName["Ignored"].KeepOrder)
+	require.True(byName["Ordered"].KeepOrder)
+	require.True(byName["Host"].KeepOrder)
+	require.False(byName["Pinned"].Ignore)
+	require.False(byName["Pinned"].KeepOrder)
+
+	ordered := Optimize(byName["Ordered"])
+	require.Equal(byName["Ordered"].Padding(), ordered.Padding())
+
+	var names []string
+	for _, f := range Optimize(byName["Pinned"]).Fields {
+		if !f.IsPadding {
+			names = append(names, f.Name)
+		}
+	}
+	require.Equal([]string{"C", "_", "B", "E", "A", "D"}, names)
+}
@@ -0,0 +1,238 @@
+package memlayout
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// atomicWriteFuncs are the prefixes of the functions and methods of
+// sync/atomic that write their operand.
+var atomicWriteFuncs = []string{"Add", "And", "CompareAndSwap", "Or", "Store", "Swap"}
+
+// writeGuards returns, for every struct field written in the given files,
+// the names of the locks held when it is written. A field written with
+// atomic operations, or a lock that is locked, is its own guard, because it
+// can be written at any time by any goroutine. Writes with no lock held are
+// ignored, since they are usually not concurrent.
+//
+// The analysis is a heuristic: locks are considered held from the call to
+// Lock to the call to Unlock in the same function, in source order.
+func writeGuards(info *types.Info, files []*ast.File) map[*types.Var][]string {
+	w := &guardsWalker{info: info, result: make(map[*types.Var][]string)}
+	for _, f := range files {
+		for _, d := range f.Decls {
+			if fn, ok := d.(*ast.FuncDecl); ok && fn.Body != nil {
+				w.walk(fn.Body, make(map[string]bool))
+			}
+		}
+	}
+	return w.result
+}
+
+type guardsWalker struct {
+	info   *types.Info
+	result map[*types.Var][]string
+}
+
+func (w *guardsWalker) walk(body ast.Node, held map[string]bool) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			w.walk(n.Body, make(map[string]bool))
+			return false
+		case *ast.DeferStmt:
+			return false
+		case *ast.AssignStmt:
+			for _, lhs := range n.Lhs {
+				w.write(lhs, held)
+			}
+		case *ast.IncDecStmt:
+			w.write(n.X, held)
+		case *ast.CallExpr:
+			w.call(n, held)
+		}
+		return true
+	})
+}
+
+func (w *guardsWalker) write(expr ast.Expr, held map[string]bool) {
+	field := w.field(expr)
+	if field == nil || len(held) == 0 {
+		return
+	}
+
+	for name := range held {
+		w.add(field, name)
+	}
+}
+
+func (w *guardsWalker) call(call *ast.CallExpr, held map[string]bool) {
+	sel, ok := astutil.Unparen(call.Fun).(*ast.SelectorExpr)
+	if !ok {
+		return
+	}
+
+	fn, ok := w.info.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == nil {
+		return
+	}
+
+	switch fn.Pkg().Path() {
+	case "sync":
+		field := w.field(sel.X)
+		if field == nil {
+			return
+		}
+
+		switch fn.Name() {
+		case "Lock", "RLock":
+			w.add(field, field.Name())
+			held[field.Name()] = true
+		case "Unlock", "RUnlock":
+			delete(held, field.Name())
+		}
+	case "sync/atomic":
+		if !isAtomicWrite(fn.Name()) {
+			return
+		}
+
+		// Either a method of an atomic type, such as x.f.Add(1), or a
+		// function, such as atomic.AddInt64(&x.f, 1).
+		field := w.field(sel.X)
+		if field == nil && len(call.Args) > 0 {
+			if addr, ok := astutil.Unparen(call.Args[0]).(*ast.UnaryExpr); ok && addr.Op == token.AND {
+				field = w.field(addr.X)
+			}
+		}
+
+		if field != nil {
+			w.add(field, field.Name())
+		}
+	}
+}
+
+// field returns the struct field selected by the expression, if any.
+func (w *guardsWalker) field(expr ast.Expr) *types.Var {
+	sel, ok := astutil.Unparen(expr).(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+
+	s, ok := w.info.Selections[sel]
+	if !ok || s.Kind() != types.FieldVal {
+		return nil
+	}
+
+	return s.Obj().(*types.Var)
+}
+
+func (w *guardsWalker) add(field *types.Var, guard string) {
+	for _, g := range w.result[field] {
+		if g == guard {
+			return
+		}
+	}
+	w.result[field] = append(w.result[field], guard)
+	sort.Strings(w.result[field])
+}
+
+func isAtomicWrite(name string) bool {
+	for _, prefix := range atomicWriteFuncs {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// SharedLine is a pair of fields written independently by different
+// goroutines that share a cache line, so writing one of them invalidates
+// the other in the cache of the other cores. This is known as false
+// sharing.
+type SharedLine struct {
+	// Line is the index of the cache line both fields share.
+	Line int
+	A, B Field
+}
+
+// FalseSharing returns the pairs of fields of the struct that are written
+// independently and share a cache line of the given size.
+func FalseSharing(s Struct, lineSize int64) []SharedLine {
+	var result []SharedLine
+	seen := make(map[[2]string]bool)
+	for _, line := range s.CacheLines(lineSize) {
+		for i, a := range line.Fields {
+			for _, b := range line.Fields[i+1:] {
+				key := [2]string{a.Name, b.Name}
+				if seen[key] || !independent(a, b) {
+					continue
+				}
+
+				seen[key] = true
+				result = append(result, SharedLine{Line: line.Index, A: a, B: b})
+			}
+		}
+	}
+	return result
+}
+
+// independent reports whether the two fields are written concurrently
+// without holding a common lock.
+func independent(a, b Field) bool {
+	if len(a.Guards) == 0 || len(b.Guards) == 0 {
+		return false
+	}
+
+	for _, ga := range a.Guards {
+		for _, gb := range b.Guards {
+			if ga == gb {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Separation is the padding that has to be added before a field so it
+// starts in a new cache line.
+type Separation struct {
+	Field   Field
+	Padding int64
+}
+
+// Separations returns the explicit padding that has to be added to the
+// struct so that no fields written independently share a cache line of
+// the given size.
+func Separations(s Struct, lineSize int64) []Separation {
+	var result []Separation
+	var shift int64
+	var written []Field
+	for _, f := range s.Fields {
+		if f.IsPadding || f.Size == 0 {
+			continue
+		}
+
+		start := f.Start + shift
+		for _, g := range written {
+			if (g.End-1)/lineSize == start/lineSize && independent(f, g) {
+				padding := lineSize - start%lineSize
+				result = append(result, Separation{Field: f, Padding: padding})
+				shift += padding
+				start += padding
+				written = nil
+				break
+			}
+		}
+
+		if len(f.Guards) > 0 {
+			f.Start, f.End = start, start+f.Size
+			written = append(written, f)
+		}
+	}
+	return result
+}
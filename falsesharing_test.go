@@ -0,0 +1,93 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const falseSharingSource = `
+package foo
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type Stats struct {
+	mu      sync.Mutex
+	count   int
+	hits    int64
+	misses  atomic.Int64
+	name    string
+}
+
+func (s *Stats) Inc() {
+	s.mu.Lock()
+	s.count++
+	s.mu.Unlock()
+	s.name = "unguarded"
+}
+
+func (s *Stats) Hit() {
+	atomic.AddInt64(&s.hits, 1)
+}
+
+func (s *Stats) Miss() {
+	go func() {
+		s.misses.Add(1)
+	}()
+}
+`
+
+func TestFalseSharing(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(falseSharingSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(falseSharingSource))
+	require.NoError(err)
+	require.Len(structs, 1)
+
+	guards := make(map[string][]string)
+	for _, f := range structs[0].Fields {
+		guards[f.Name] = f.Guards
+	}
+	require.Equal(map[string][]string{
+		"mu":     {"mu"},
+		"count":  {"mu"},
+		"hits":   {"hits"},
+		"misses": {"misses"},
+		"name":   nil,
+	}, guards)
+
+	var pairs [][2]string
+	for _, sl := range FalseSharing(structs[0], CacheLineSize) {
+		require.Equal(0, sl.Line)
+		pairs = append(pairs, [2]string{sl.A.Name, sl.B.Name})
+	}
+	require.Equal([][2]string{
+		{"mu", "hits"},
+		{"mu", "misses"},
+		{"count", "hits"},
+		{"count", "misses"},
+		{"hits", "misses"},
+	}, pairs)
+
+	seps := Separations(structs[0], CacheLineSize)
+	require.Len(seps, 2)
+	require.Equal("hits", seps[0].Field.Name)
+	require.Equal(int64(48), seps[0].Padding)
+	require.Equal("misses", seps[1].Field.Name)
+	require.Equal(int64(56), seps[1].Padding)
+}
@@ -0,0 +1,301 @@
+package memlayout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	lookout "gopkg.in/src-d/lookout-sdk.v0/pb"
+)
+
+// errNoModule is returned when a repository has no go.mod file, so the
+// import paths of its packages cannot be known without a checkout.
+var errNoModule = errors.New("repository is not a Go module")
+
+// moduleFilesPattern matches the files that are always fetched: the ones
+// defining the modules and workspaces of the repository, wherever they
+// are, and the configuration in its root.
+const moduleFilesPattern = `^((.*/)?(go\.mod|go\.sum|go\.work|go\.work\.sum|vendor/modules\.txt)|\.memlayout\.yml)$`
+
+// fetchFiles returns the files of the given revision of a repository needed
+// to load the packages in the given directories, by path relative to the
+// root of the repository. They are fetched from the data server, along
+// with the ones of the packages of the modules of the repository, or of
+// their vendor directories, imported by them or by their tests, directly
+// or indirectly. Packages importing them are not fetched.
+func fetchFiles(ctx context.Context, client lookout.DataClient, rev *lookout.ReferencePointer, dirs []string) (map[string][]byte, error) {
+	files, err := getFiles(ctx, client, rev, moduleFilesPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	modules := repoModules(files)
+	if len(modules) == 0 {
+		return nil, errNoModule
+	}
+
+	// The tests of the given directories are loaded too, but not the ones
+	// of their dependencies.
+	var tested = make(map[string]bool)
+	for _, dir := range dirs {
+		tested[path.Clean(dir)] = true
+	}
+
+	if err := fetchPackages(ctx, client, rev, files, modules, dirs, tested); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// fetchImporters returns the files of the given revision of a repository
+// needed to load the packages of its modules importing the ones in the
+// given directories, directly or indirectly, by path relative to the root
+// of the repository. The given files are the ones already fetched by
+// fetchFiles, and are not returned. The Go files of the repository,
+// except tests and vendored ones, have to be fetched to find the
+// importers, but only the vendored packages they import are fetched
+// along with them.
+func fetchImporters(ctx context.Context, client lookout.DataClient, rev *lookout.ReferencePointer, files map[string][]byte, dirs []string) (map[string][]byte, error) {
+	all, err := requestFiles(ctx, client, &lookout.FilesRequest{
+		Revision:        rev,
+		IncludePattern:  `\.go$`,
+		ExcludePattern:  `_test\.go$`,
+		ExcludeVendored: true,
+		WantContents:    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	modules := repoModules(files)
+	var importedBy = make(map[string][]string)
+	var imports = make(map[string][]string)
+	for name, content := range all {
+		imports[name] = importedDirs(name, content, files, modules)
+		for _, dir := range imports[name] {
+			importedBy[dir] = append(importedBy[dir], path.Dir(name))
+		}
+	}
+
+	var importers = make(map[string]bool)
+	for len(dirs) > 0 {
+		dir := path.Clean(dirs[0])
+		dirs = dirs[1:]
+		for _, importer := range importedBy[dir] {
+			if !importers[importer] {
+				importers[importer] = true
+				dirs = append(dirs, importer)
+			}
+		}
+	}
+
+	var result = make(map[string][]byte)
+	for name, content := range files {
+		result[name] = content
+	}
+
+	var vendored []string
+	for name, content := range all {
+		if !importers[path.Dir(name)] {
+			continue
+		}
+
+		result[name] = content
+		for _, dir := range imports[name] {
+			if strings.Contains("/"+dir+"/", "/vendor/") {
+				vendored = append(vendored, dir)
+			}
+		}
+	}
+
+	if err := fetchPackages(ctx, client, rev, result, modules, vendored, nil); err != nil {
+		return nil, err
+	}
+
+	for name := range files {
+		delete(result, name)
+	}
+	return result, nil
+}
+
+// fetchPackages fetches the files of the packages in the given directories
+// into the given files, along with the ones of the packages of the given
+// modules, or of their vendor directories, imported by them, directly or
+// indirectly. The imports of tests are only followed for the given tested
+// directories.
+func fetchPackages(ctx context.Context, client lookout.DataClient, rev *lookout.ReferencePointer, files map[string][]byte, modules map[string]string, dirs []string, tested map[string]bool) error {
+	var fetched = make(map[string]bool)
+	for len(dirs) > 0 {
+		var patterns []string
+		for _, dir := range dirs {
+			dir = path.Clean(dir)
+			if fetched[dir] {
+				continue
+			}
+			fetched[dir] = true
+
+			if dir == "." {
+				patterns = append(patterns, `[^/]+\.go`)
+			} else {
+				patterns = append(patterns, regexp.QuoteMeta(dir)+`/[^/]+\.go`)
+			}
+		}
+
+		if len(patterns) == 0 {
+			break
+		}
+		sort.Strings(patterns)
+
+		got, err := getFiles(ctx, client, rev, "^("+strings.Join(patterns, "|")+")$")
+		if err != nil {
+			return err
+		}
+
+		dirs = nil
+		for name, content := range got {
+			files[name] = content
+			if tested[path.Dir(name)] || !strings.HasSuffix(name, "_test.go") {
+				dirs = append(dirs, importedDirs(name, content, files, modules)...)
+			}
+		}
+	}
+
+	return nil
+}
+
+// repoModules returns the directories of the modules of the repository
+// with the given files, relative to its root, by module path.
+func repoModules(files map[string][]byte) map[string]string {
+	var result = make(map[string]string)
+	for name, content := range files {
+		if path.Base(name) != "go.mod" {
+			continue
+		}
+
+		if module := modulePath(content); module != "" {
+			result[module] = path.Dir(name)
+		}
+	}
+	return result
+}
+
+// moduleDir returns the directory of the module containing the given
+// directory, which is the closest one with a go.mod file, or false if there
+// is none.
+func moduleDir(dir string, files map[string][]byte) (string, bool) {
+	for {
+		if _, ok := files[path.Join(dir, "go.mod")]; ok {
+			return dir, true
+		}
+
+		if dir == "." {
+			return "", false
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// getFiles returns the files of the given revision whose path matches the
+// given pattern.
+func getFiles(ctx context.Context, client lookout.DataClient, rev *lookout.ReferencePointer, pattern string) (map[string][]byte, error) {
+	return requestFiles(ctx, client, &lookout.FilesRequest{
+		Revision:       rev,
+		IncludePattern: pattern,
+		WantContents:   true,
+	})
+}
+
+// requestFiles returns the files the data server returns for the given
+// request, by path.
+func requestFiles(ctx context.Context, client lookout.DataClient, req *lookout.FilesRequest) (map[string][]byte, error) {
+	stream, err := client.GetFiles(ctx, req)
+	if err != nil {
+		return nil, fmt.Errorf("error getting files from data server: %s", err)
+	}
+
+	var result = make(map[string][]byte)
+	for {
+		file, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not receive files from data server: %s", err)
+		}
+
+		result[file.Path] = file.Content
+	}
+
+	return result, nil
+}
+
+// importedDirs returns the directories, relative to the root of the
+// repository, of the packages imported by the file with the given path and
+// content that are in the given modules of the repository, or in the
+// vendor directory of the module of the file.
+func importedDirs(filename string, content []byte, files map[string][]byte, modules map[string]string) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), filename, content, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+
+	var own, vendor string
+	if dir, ok := moduleDir(path.Dir(filename), files); ok {
+		own = modulePath(files[path.Join(dir, "go.mod")])
+		if _, ok := files[path.Join(dir, "vendor", "modules.txt")]; ok {
+			vendor = path.Join(dir, "vendor")
+		}
+	}
+
+	var result []string
+	for _, imp := range f.Imports {
+		p, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			continue
+		}
+
+		if !inModule(p, own) && vendor != "" && strings.Contains(strings.SplitN(p, "/", 2)[0], ".") {
+			result = append(result, path.Join(vendor, p))
+			continue
+		}
+
+		// Packages of nested modules belong to the longest module path.
+		var module string
+		for m := range modules {
+			if inModule(p, m) && len(m) > len(module) {
+				module = m
+			}
+		}
+
+		if module != "" {
+			result = append(result, path.Join(modules[module], strings.TrimPrefix(p, module)))
+		}
+	}
+	return result
+}
+
+// inModule reports whether the package with the given import path is in
+// the module with the given path.
+func inModule(importPath, module string) bool {
+	return module != "" && (importPath == module || strings.HasPrefix(importPath, module+"/"))
+}
+
+// modulePath returns the module path declared in the given go.mod file, or
+// an empty string if there is none.
+func modulePath(gomod []byte) string {
+	for _, line := range strings.Split(string(gomod), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package memlayout
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	lookout "gopkg.in/src-d/lookout-sdk.v0/pb"
+)
+
+func TestFetchFiles(t *testing.T) {
+	require := require.New(t)
+
+	client := &fakeDataClient{files: map[string]string{
+		"go.mod":       "module example.com/root\n\ngo 1.22\n",
+		"go.work":      "go 1.22\n\nuse (\n\t.\n\t./n\n)\n",
+		"README.md":    "# root\n",
+		"a/a.go":       "package a\n\nimport (\n\t\"fmt\"\n\n\t\"example.com/root/b\"\n)\n\ntype A struct {\n\tX bool\n\tB b.B\n\tY bool\n}\n\nvar _ = fmt.Sprint\n",
+		"a/a_test.go":  "package a\n\nimport \"example.com/root/d\"\n\nvar _ d.D\n",
+		"b/b.go":       "package b\n\nimport (\n\t\"example.com/root/c\"\n\t\"example.com/root/n/m\"\n)\n\ntype B struct {\n\tC c.C\n\tM m.M\n}\n",
+		"c/c.go":       "package c\n\ntype C struct {\n\tI int64\n}\n",
+		"c/sub/sub.go": "package sub\n",
+		"b/b_test.go":  "package b\n\nimport \"example.com/root/e\"\n\nvar _ e.E\n",
+		"d/d.go":       "package d\n\ntype D struct{}\n",
+		"e/e.go":       "package e\n\ntype E struct{}\n",
+		"n/go.mod":     "module example.com/root/n\n\ngo 1.22\n",
+		"n/m/m.go":     "package m\n\ntype M struct {\n\tI int64\n}\n",
+		"n/o/o.go":     "package o\n",
+	}}
+
+	files, err := fetchFiles(context.Background(), client, &lookout.ReferencePointer{}, []string{"a"})
+	require.NoError(err)
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Only the imports of the tests of the given directories are fetched.
+	require.Equal([]string{
+		"a/a.go", "a/a_test.go", "b/b.go", "b/b_test.go", "c/c.go", "d/d.go",
+		"go.mod", "go.work", "n/go.mod", "n/m/m.go",
+	}, names)
+
+	_, err = fetchFiles(context.Background(), &fakeDataClient{}, &lookout.ReferencePointer{}, []string{"a"})
+	require.Equal(errNoModule, err)
+
+	// The fetched files are enough to load the package, even if they only
+	// exist in the overlay.
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	var overlay = make(map[string][]byte)
+	for name, content := range files {
+		overlay[filepath.Join(tmp, filepath.FromSlash(name))] = content
+	}
+
+	path := filepath.Join(tmp, "a", "a.go")
+	structs, err := structsForBuild(LoadPackage, path, files["a/a.go"], Build{}, overlay)
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal(int64(32), structs[0].Size())
+}
+
+func TestFetchImporters(t *testing.T) {
+	require := require.New(t)
+
+	client := &fakeDataClient{files: map[string]string{
+		"go.mod":                    "module example.com/root\n\ngo 1.22\n",
+		"vendor/modules.txt":        "# example.org/v v1.0.0\n## explicit\nexample.org/v\n",
+		"vendor/example.org/v/v.go": "package v\n\nimport \"example.org/w\"\n\ntype V struct{}\n\nvar _ w.W\n",
+		"vendor/example.org/w/w.go": "package w\n\ntype W struct{}\n",
+		"vendor/example.org/x/x.go": "package x\n",
+		"a/a.go":                    "package a\n\ntype A struct {\n\tI int64\n}\n",
+		"b/b.go":                    "package b\n\nimport (\n\t\"example.com/root/a\"\n\t\"example.org/v\"\n)\n\ntype B struct {\n\tA a.A\n\tV v.V\n}\n",
+		"b/b_test.go":               "package b\n\nimport \"example.org/x\"\n\nvar _ x.X\n",
+		"c/c.go":                    "package c\n\nimport \"example.com/root/b\"\n\ntype C struct {\n\tB b.B\n}\n",
+		"d/d.go":                    "package d\n\ntype D struct{}\n",
+		"e/e_test.go":               "package e\n\nimport \"example.com/root/a\"\n\nvar _ a.A\n",
+	}}
+
+	files, err := fetchFiles(context.Background(), client, &lookout.ReferencePointer{}, []string{"a"})
+	require.NoError(err)
+
+	importers, err := fetchImporters(context.Background(), client, &lookout.ReferencePointer{}, files, []string{"a"})
+	require.NoError(err)
+
+	var names []string
+	for name := range importers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// The packages importing the changed one directly or indirectly are
+	// fetched, with the vendored packages they import, but not their tests.
+	require.Equal([]string{
+		"b/b.go", "c/c.go", "vendor/example.org/v/v.go", "vendor/example.org/w/w.go",
+	}, names)
+}
+
+// fakeDataClient is a data server client that serves the files of a
+// revision from a map.
+type fakeDataClient struct {
+	files map[string]string
+}
+
+func (c *fakeDataClient) GetChanges(context.Context, *lookout.ChangesRequest, ...grpc.CallOption) (lookout.Data_GetChangesClient, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeDataClient) GetFiles(ctx context.Context, req *lookout.FilesRequest, opts ...grpc.CallOption) (lookout.Data_GetFilesClient, error) {
+	re, err := regexp.Compile(req.IncludePattern)
+	if err != nil {
+		return nil, err
+	}
+
+	exclude, err := regexp.Compile(req.ExcludePattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range c.files {
+		if !re.MatchString(name) || req.ExcludePattern != "" && exclude.MatchString(name) {
+			continue
+		}
+
+		if req.ExcludeVendored && strings.Contains("/"+name, "/vendor/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var stream fakeFilesStream
+	for _, name := range names {
+		stream.files = append(stream.files, &lookout.File{Path: name, Content: []byte(c.files[name])})
+	}
+	return &stream, nil
+}
+
+type fakeFilesStream struct {
+	grpc.ClientStream
+	files []*lookout.File
+}
+
+func (s *fakeFilesStream) Recv() (*lookout.File, error) {
+	if len(s.files) == 0 {
+		return nil, io.EOF
+	}
+
+	f := s.files[0]
+	s.files = s.files[1:]
+	return f, nil
+}
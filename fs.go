@@ -0,0 +1,535 @@
+package memlayout
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// FS is a read-only file system packages can be loaded from, so their
+// sources do not need to be on disk. Paths are slash-separated and
+// relative to the root of the file system.
+type FS interface {
+	// ReadFile returns the content of the file with the given path.
+	ReadFile(path string) ([]byte, error)
+	// ReadDir returns the entries of the directory with the given path.
+	ReadDir(path string) ([]os.FileInfo, error)
+}
+
+// MapFS is a FS with the content of its files by path. Directories are
+// implied by the paths of the files.
+type MapFS map[string][]byte
+
+// ReadFile implements the FS interface.
+func (m MapFS) ReadFile(p string) ([]byte, error) {
+	content, ok := m[path.Clean(p)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	return content, nil
+}
+
+// ReadDir implements the FS interface.
+func (m MapFS) ReadDir(p string) ([]os.FileInfo, error) {
+	var prefix string
+	if p = path.Clean(p); p != "." {
+		prefix = p + "/"
+	}
+
+	var entries = make(map[string]os.FileInfo)
+	for name, content := range m {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		rest := strings.TrimPrefix(name, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			entries[rest[:i]] = fileInfo{name: rest[:i], dir: true}
+		} else {
+			entries[rest] = fileInfo{name: rest, size: int64(len(content))}
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+
+	var result []os.FileInfo
+	for _, e := range entries {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+// fileInfo is the os.FileInfo of a file of a FS that is not on disk.
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi fileInfo) IsDir() bool        { return fi.dir }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fi fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// BillyFS returns a FS backed by the given billy file system, such as the
+// worktree of a go-git repository or an in-memory one.
+func BillyFS(fs billy.Filesystem) FS {
+	return billyFS{fs}
+}
+
+type billyFS struct {
+	fs billy.Filesystem
+}
+
+func (b billyFS) ReadFile(p string) ([]byte, error) {
+	f, err := b.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (b billyFS) ReadDir(p string) ([]os.FileInfo, error) {
+	return b.fs.ReadDir(p)
+}
+
+// TreeFS returns a FS with the files of the given git tree, such as the
+// one of a commit, read straight from the objects of the repository.
+func TreeFS(tree *object.Tree) FS {
+	return treeFS{tree}
+}
+
+type treeFS struct {
+	tree *object.Tree
+}
+
+func (t treeFS) ReadFile(p string) ([]byte, error) {
+	dir, err := t.dir(path.Dir(path.Clean(p)))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+
+	name := path.Base(p)
+	for _, e := range dir.Entries {
+		if e.Name == name && e.Mode.IsFile() {
+			f, err := dir.File(name)
+			if err != nil {
+				return nil, err
+			}
+
+			content, err := f.Contents()
+			if err != nil {
+				return nil, err
+			}
+			return []byte(content), nil
+		}
+	}
+
+	return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+}
+
+func (t treeFS) ReadDir(p string) ([]os.FileInfo, error) {
+	tree, err := t.dir(path.Clean(p))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+
+	// Sizes are not known without reading the blobs, and they are not
+	// needed to load packages.
+	var result []os.FileInfo
+	for _, e := range tree.Entries {
+		result = append(result, fileInfo{name: e.Name, dir: !e.Mode.IsFile()})
+	}
+	return result, nil
+}
+
+// dir returns the tree of the directory with the given path. It is looked
+// up one level at a time, because looking up paths that do not exist in
+// some trees makes go-git panic.
+func (t treeFS) dir(p string) (*object.Tree, error) {
+	tree := t.tree
+	if p == "." {
+		return tree, nil
+	}
+
+	for _, name := range strings.Split(p, "/") {
+		var found bool
+		for _, e := range tree.Entries {
+			if e.Name == name && !e.Mode.IsFile() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, os.ErrNotExist
+		}
+
+		var err error
+		tree, err = tree.Tree(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// LoadPackageFS loads and type-checks the package in the given directory of
+// the file system for the given build configuration, without reading or
+// writing any source on disk. The packages of the same module, found with
+// the go.mod file closest to the directory, and the ones in its vendor
+// directory are type-checked from the file system too, and the ones of the
+// standard library from the sources in GOROOT, so they have the layout of
+// the build and not the one of the host. Importing any other package, or
+// any other type error, is an error, as the layout of the structs could
+// not be known.
+func LoadPackageFS(fsys FS, dir string, build Build) (*Package, error) {
+	fset := token.NewFileSet()
+	l := &fsLoader{
+		fs:      fsys,
+		build:   build,
+		fset:    fset,
+		pkgs:    make(map[string]*Package),
+		errs:    make(map[string]error),
+		loading: make(map[string]bool),
+		std: &fsLoader{
+			fs:      stdFS(),
+			build:   build,
+			fset:    fset,
+			pkgs:    make(map[string]*Package),
+			errs:    make(map[string]error),
+			loading: make(map[string]bool),
+			goroot:  true,
+		},
+	}
+	l.root, l.module = l.findModule(path.Clean(dir))
+
+	return l.load(path.Clean(dir))
+}
+
+// StructsFromFS returns the structs in the file with the given path of the
+// file system, when its package is loaded for the given build
+// configuration with LoadPackageFS. Structs are laid out for the
+// architecture of the build, if any, or DefaultArch.
+func StructsFromFS(fsys FS, filename string, build Build) ([]Struct, error) {
+	filename = path.Clean(filename)
+	pkg, err := LoadPackageFS(fsys, path.Dir(filename), build)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range pkg.Files {
+		if pkg.Fset.File(f.Pos()).Name() == filename {
+			return pkg.structs(f, build), nil
+		}
+	}
+
+	return nil, &notInBuildError{filename: filename, build: build}
+}
+
+// fsLoader loads packages from a FS.
+type fsLoader struct {
+	fs    FS
+	build Build
+	fset  *token.FileSet
+	// std loads the packages of the standard library, and goroot reports
+	// whether this is the loader of the standard library.
+	std    *fsLoader
+	goroot bool
+	// root is the directory of the go.mod file of the module, if any, and
+	// module its path.
+	root   string
+	module string
+	// pkgs are the packages already loaded by directory, and errs the
+	// errors of the ones that could not be loaded, so they are not
+	// type-checked again by every package importing them.
+	pkgs    map[string]*Package
+	errs    map[string]error
+	loading map[string]bool
+}
+
+// stdFS returns the file system with the sources of the standard library
+// in GOROOT.
+func stdFS() FS {
+	return BillyFS(osfs.New(filepath.Join(build.Default.GOROOT, "src")))
+}
+
+// findModule returns the directory of the closest go.mod file to the given
+// directory and the path of its module, or empty strings if there is none.
+func (l *fsLoader) findModule(dir string) (string, string) {
+	for {
+		if content, err := l.fs.ReadFile(path.Join(dir, "go.mod")); err == nil {
+			return dir, modulePath(content)
+		}
+
+		if dir == "." || dir == "/" {
+			return "", ""
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// context returns the build context to select the files of the packages
+// in the file system.
+func (l *fsLoader) context() build.Context {
+	ctx := build.Default
+	ctx.GOOS = l.build.goos()
+	ctx.GOARCH = l.build.goarch()
+	ctx.ToolTags = toolTags(ctx.GOOS, ctx.GOARCH)
+	ctx.BuildTags = l.build.Tags
+	ctx.CgoEnabled = false
+	ctx.GOROOT = ""
+	ctx.GOPATH = ""
+	ctx.JoinPath = path.Join
+	ctx.IsAbsPath = path.IsAbs
+	ctx.SplitPathList = func(list string) []string { return strings.Split(list, ":") }
+	ctx.HasSubdir = func(root, dir string) (string, bool) { return "", false }
+	ctx.ReadDir = l.fs.ReadDir
+	ctx.IsDir = func(p string) bool {
+		_, err := l.fs.ReadDir(p)
+		return err == nil
+	}
+	ctx.OpenFile = func(p string) (io.ReadCloser, error) {
+		content, err := l.fs.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	return ctx
+}
+
+// archLevelTags are the tool tags of the default microarchitecture level
+// of every architecture, such as GOAMD64=v1 or GOARM=7.
+var archLevelTags = map[string][]string{
+	"386":      {"386.sse2"},
+	"amd64":    {"amd64.v1"},
+	"arm":      {"arm.5", "arm.6", "arm.7"},
+	"arm64":    {"arm64.v8.0"},
+	"mips":     {"mips.hardfloat"},
+	"mipsle":   {"mipsle.hardfloat"},
+	"mips64":   {"mips64.hardfloat"},
+	"mips64le": {"mips64le.hardfloat"},
+	"ppc64":    {"ppc64.power8"},
+	"ppc64le":  {"ppc64le.power8"},
+	"riscv64":  {"riscv64.rva20u64"},
+	"wasm":     {"wasm.satconv", "wasm.signext"},
+}
+
+// toolTags returns the tool tags the go command would use to build for the
+// given GOOS and GOARCH. The ones of the host are only right for the host:
+// the standard library does not type-check for other architectures with
+// them. Experiments that do not depend on the target are kept as they are
+// in the toolchain.
+func toolTags(goos, goarch string) []string {
+	if goos == build.Default.GOOS && goarch == build.Default.GOARCH {
+		return build.Default.ToolTags
+	}
+
+	var tags []string
+	for _, tag := range build.Default.ToolTags {
+		switch tag {
+		case "goexperiment.regabiwrappers", "goexperiment.regabiargs", "goexperiment.dwarf5":
+		default:
+			if strings.HasPrefix(tag, "goexperiment.") {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	switch goarch {
+	case "amd64", "arm64", "loong64", "ppc64", "ppc64le", "riscv64", "s390x":
+		tags = append(tags, "goexperiment.regabiwrappers", "goexperiment.regabiargs")
+	}
+
+	switch goos {
+	case "darwin", "ios", "aix":
+	default:
+		tags = append(tags, "goexperiment.dwarf5")
+	}
+
+	return append(tags, archLevelTags[goarch]...)
+}
+
+// importPath returns the import path of the package in the given
+// directory.
+func (l *fsLoader) importPath(dir string) string {
+	if l.module == "" {
+		return dir
+	}
+	if dir == l.root {
+		return l.module
+	}
+	return l.module + "/" + strings.TrimPrefix(dir, l.root+"/")
+}
+
+// dirOf returns the directory of the file system with the package with the
+// given import path, or false if it is not in the file system.
+func (l *fsLoader) dirOf(importPath string) (string, bool) {
+	if l.goroot {
+		// Packages of the standard library may import the ones in its
+		// vendor directory.
+		for _, d := range []string{path.Join("vendor", importPath), importPath} {
+			if l.isDir(d) {
+				return d, true
+			}
+		}
+		return "", false
+	}
+
+	if l.module == "" {
+		return "", false
+	}
+
+	switch {
+	case importPath == l.module:
+		return l.root, true
+	case strings.HasPrefix(importPath, l.module+"/"):
+		return path.Join(l.root, strings.TrimPrefix(importPath, l.module+"/")), true
+	}
+
+	vendored := path.Join(l.root, "vendor", importPath)
+	if l.isDir(vendored) {
+		return vendored, true
+	}
+	return "", false
+}
+
+// isDir reports whether the given directory exists and is not empty. Some
+// file systems, such as the in-memory one of billy, return no entries
+// instead of an error for directories that do not exist.
+func (l *fsLoader) isDir(dir string) bool {
+	entries, err := l.fs.ReadDir(dir)
+	return err == nil && len(entries) > 0
+}
+
+func (l *fsLoader) load(dir string) (*Package, error) {
+	if pkg, ok := l.pkgs[dir]; ok {
+		return pkg, nil
+	}
+	if err, ok := l.errs[dir]; ok {
+		return nil, err
+	}
+	if l.loading[dir] {
+		return nil, fmt.Errorf("import cycle through %s", dir)
+	}
+	l.loading[dir] = true
+	defer delete(l.loading, dir)
+
+	pkg, err := l.check(dir)
+	if err != nil {
+		l.errs[dir] = err
+		return nil, err
+	}
+
+	l.pkgs[dir] = pkg
+	return pkg, nil
+}
+
+// check parses and type-checks the package in the given directory.
+func (l *fsLoader) check(dir string) (*Package, error) {
+	ctx := l.context()
+	bp, err := ctx.ImportDir(dir, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load package in %s: %s", dir, err)
+	}
+
+	var files []*ast.File
+	var contents = make(map[*ast.File][]byte)
+	for _, name := range bp.GoFiles {
+		filename := path.Join(dir, name)
+		content, err := l.fs.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := parser.ParseFile(l.fset, filename, content, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse file %s: %s", filename, err)
+		}
+		files = append(files, f)
+		contents[f] = content
+	}
+
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Instances:  make(map[*ast.Ident]types.Instance),
+	}
+
+	var typeErrs []error
+	conf := types.Config{
+		Importer: importerFunc(func(importPath string) (*types.Package, error) {
+			if importPath == "unsafe" {
+				return types.Unsafe, nil
+			}
+
+			for _, loader := range []*fsLoader{l, l.std} {
+				if loader == nil {
+					continue
+				}
+
+				if d, ok := loader.dirOf(importPath); ok {
+					pkg, err := loader.load(d)
+					if err != nil {
+						return nil, err
+					}
+					return pkg.Types, nil
+				}
+			}
+
+			return nil, fmt.Errorf("package %s is not in the module, its vendor directory or the standard library", importPath)
+		}),
+		FakeImportC: true,
+		// Only the declarations of the standard library are needed.
+		IgnoreFuncBodies: l.goroot,
+		Error:            func(err error) { typeErrs = append(typeErrs, err) },
+	}
+
+	importPath := l.importPath(dir)
+	pkg, _ := conf.Check(importPath, l.fset, files, info)
+	if len(typeErrs) > 0 {
+		return nil, fmt.Errorf("unable to type-check package in %s: %s", dir, typeErrs[0])
+	}
+
+	return &Package{
+		Path:     importPath,
+		Dir:      dir,
+		Module:   l.module,
+		Fset:     l.fset,
+		Files:    files,
+		Types:    pkg,
+		Info:     info,
+		contents: contents,
+		readFile: l.fs.ReadFile,
+	}, nil
+}
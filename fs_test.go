@@ -0,0 +1,135 @@
+package memlayout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+var fsFiles = map[string]string{
+	"go.mod":                    "module example.com/m\n",
+	"a/a.go":                    "package a\n\nimport (\n\t\"sync\"\n\n\t\"example.com/m/b\"\n\t\"example.org/v\"\n)\n\ntype A struct {\n\tX  bool\n\tMu sync.Mutex\n\tB  b.B\n\tV  v.V\n}\n",
+	"a/a_arm64.go":              "package a\n\ntype OnlyArm struct{}\n",
+	"b/b.go":                    "package b\n\ntype B struct {\n\tI int64\n}\n",
+	"vendor/modules.txt":        "# example.org/v v1.0.0\nexample.org/v\n",
+	"vendor/example.org/v/v.go": "package v\n\ntype V struct {\n\tS string\n}\n",
+}
+
+func TestStructsFromFS(t *testing.T) {
+	require := require.New(t)
+
+	var mapFS = make(MapFS)
+	mem := memfs.New()
+	for name, content := range fsFiles {
+		mapFS[name] = []byte(content)
+
+		f, err := mem.Create(name)
+		require.NoError(err)
+		_, err = f.Write([]byte(content))
+		require.NoError(err)
+		require.NoError(f.Close())
+	}
+
+	// The worktree is committed so the files can be read from the tree
+	// of the commit.
+	repo, err := git.Init(memory.NewStorage(), mem)
+	require.NoError(err)
+	w, err := repo.Worktree()
+	require.NoError(err)
+	_, err = w.Add(".")
+	require.NoError(err)
+	hash, err := w.Commit("files", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(err)
+	commit, err := repo.CommitObject(hash)
+	require.NoError(err)
+	tree, err := commit.Tree()
+	require.NoError(err)
+
+	for name, fsys := range map[string]FS{
+		"map":   mapFS,
+		"billy": BillyFS(mem),
+		"tree":  TreeFS(tree),
+	} {
+		structs, err := StructsFromFS(fsys, "a/a.go", Build{GOOS: "linux", GOARCH: "amd64"})
+		require.NoError(err, name)
+		require.Len(structs, 1, name)
+		require.Equal("A", structs[0].Name, name)
+		require.Equal(int64(40), structs[0].Size(), name)
+
+		pkg, err := LoadPackageFS(fsys, "a", Build{GOOS: "linux", GOARCH: "arm64"})
+		require.NoError(err, name)
+		require.Equal("example.com/m/a", pkg.Path, name)
+		require.NotNil(pkg.Types.Scope().Lookup("OnlyArm"), name)
+	}
+
+	_, err = StructsFromFS(mapFS, "a/a_arm64.go", Build{GOOS: "linux", GOARCH: "amd64"})
+	require.Error(err)
+
+	// The standard library is loaded for the build, not for the host.
+	mapFS["s/s.go"] = []byte("package s\n\nimport \"syscall\"\n\ntype S struct {\n\tStat syscall.Stat_t\n}\n")
+	for arch, size := range map[string]int64{"amd64": 144, "arm64": 128, "386": 96, "arm": 104} {
+		structs, err := StructsFromFS(mapFS, "s/s.go", Build{GOOS: "linux", GOARCH: arch})
+		require.NoError(err, arch)
+		require.Len(structs, 1, arch)
+		require.Equal(size, structs[0].Size(), arch)
+	}
+
+	// The standard library is type-checked with the tool tags of the
+	// build, which select the files of its architecture.
+	mapFS["h/h.go"] = []byte("package h\n\nimport \"net/http\"\n\ntype H struct {\n\tOK  bool\n\tReq http.Request\n}\n")
+	for _, b := range []Build{
+		{GOOS: "linux", GOARCH: "386"},
+		{GOOS: "linux", GOARCH: "arm"},
+		{GOOS: "js", GOARCH: "wasm"},
+	} {
+		structs, err := StructsFromFS(mapFS, "h/h.go", b)
+		require.NoError(err, b.String())
+		require.Len(structs, 1, b.String())
+	}
+
+	// Packages that are not in the module, its vendor directory or the
+	// standard library cannot be laid out.
+	mapFS["c/c.go"] = []byte("package c\n\nimport \"example.org/missing\"\n\ntype C struct {\n\tM missing.M\n}\n")
+	_, err = StructsFromFS(mapFS, "c/c.go", Build{GOOS: "linux", GOARCH: "amd64"})
+	require.Error(err)
+	require.Contains(err.Error(), "example.org/missing")
+}
+
+func TestLoadPackageFSErrors(t *testing.T) {
+	require := require.New(t)
+
+	fsys := &countingFS{FS: MapFS{
+		"go.mod":     []byte("module example.com/m\n"),
+		"a/a.go":     []byte("package a\n\nimport (\n\t\"example.com/m/b\"\n\t\"example.com/m/c\"\n)\n\nvar _, _ = b.B, c.C\n"),
+		"b/b.go":     []byte("package b\n\nimport \"example.com/m/bad\"\n\nvar B = bad.Bad\n"),
+		"c/c.go":     []byte("package c\n\nimport \"example.com/m/bad\"\n\nvar C = bad.Bad\n"),
+		"bad/bad.go": []byte("package bad\n\nvar Bad = undefined\n"),
+	}, reads: make(map[string]int)}
+
+	_, err := LoadPackageFS(fsys, "a", Build{GOOS: "linux", GOARCH: "amd64"})
+	require.Error(err)
+	require.Contains(err.Error(), "undefined")
+
+	// The package that failed to load is not loaded again for every
+	// package importing it: its file is only read once for its build
+	// constraints and once to parse it.
+	require.Equal(2, fsys.reads["bad/bad.go"])
+}
+
+// countingFS is a FS that counts the reads of every file.
+type countingFS struct {
+	FS
+	reads map[string]int
+}
+
+func (c *countingFS) ReadFile(p string) ([]byte, error) {
+	c.reads[p]++
+	return c.FS.ReadFile(p)
+}
@@ -0,0 +1,175 @@
+package memlayout
+
+import (
+	"go/types"
+	"sort"
+)
+
+// instancesOf returns the concrete instantiations of the given generic type
+// used in the package, sorted by their type arguments. Instantiations with
+// type parameters as arguments, such as the ones inside the declaration of
+// the type itself, are not concrete and are skipped.
+func instancesOf(generic *types.Named, info *types.Info) []*types.Named {
+	var keys []string
+	seen := make(map[string]*types.Named)
+	for _, inst := range info.Instances {
+		named, ok := inst.Type.(*types.Named)
+		if !ok || named.Origin() != generic || hasTypeParams(inst.TypeArgs) {
+			continue
+		}
+
+		key := named.String()
+		if _, ok := seen[key]; !ok {
+			keys = append(keys, key)
+			seen[key] = named
+		}
+	}
+
+	sort.Strings(keys)
+	result := make([]*types.Named, len(keys))
+	for i, key := range keys {
+		result[i] = seen[key]
+	}
+	return result
+}
+
+func hasTypeParams(list *types.TypeList) bool {
+	for i := 0; i < list.Len(); i++ {
+		if hasTypeParam(list.At(i)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTypeParam(typ types.Type) bool {
+	switch t := typ.(type) {
+	case *types.TypeParam:
+		return true
+	case *types.Pointer:
+		return hasTypeParam(t.Elem())
+	case *types.Slice:
+		return hasTypeParam(t.Elem())
+	case *types.Array:
+		return hasTypeParam(t.Elem())
+	case *types.Chan:
+		return hasTypeParam(t.Elem())
+	case *types.Map:
+		return hasTypeParam(t.Key()) || hasTypeParam(t.Elem())
+	case *types.Named:
+		return hasTypeParams(t.TypeArgs())
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if hasTypeParam(t.Field(i).Type()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// originField returns the field of the declared struct origin that the
+// given field of its instantiation typ comes from.
+func originField(v *types.Var, typ, origin *types.Struct) *types.Var {
+	if typ == origin {
+		return v
+	}
+
+	for i := 0; i < typ.NumFields(); i++ {
+		if typ.Field(i) == v {
+			return origin.Field(i)
+		}
+	}
+	return v
+}
+
+// OptimizeGeneric returns the given instantiations of the same generic
+// struct with the single field order that minimizes their total size in the
+// architectures of the options, as all of them share one declaration. It
+// also reports whether that order is optimal for every instantiation, which
+// is not the case when the type arguments change the alignment or size of
+// the fields in different ways.
+func OptimizeGeneric(instances []Struct, opts Options) ([]Struct, bool) {
+	if len(instances) == 0 || instances[0].KeepOrder {
+		return instances, true
+	}
+
+	nested := make([]Struct, len(instances))
+	for i, inst := range instances {
+		nested[i] = inst.withNested(opts)
+	}
+	instances = nested
+
+	var candidates [][]int
+	optimal := make([]int64, len(instances))
+	for i, inst := range instances {
+		optimized := OptimizeWith(inst, opts)
+		candidates = append(candidates, permutation(inst.vars(), optimized.vars()))
+		optimal[i] = totalSize(optimized.vars(), opts.archs(inst))
+	}
+
+	var best []int
+	var bestSize int64 = -1
+candidates:
+	for _, candidate := range candidates {
+		// An order that keeps the atomic fields of one instantiation
+		// aligned may misalign the ones of another.
+		var size int64
+		for _, inst := range instances {
+			vars := reorder(inst.vars(), candidate)
+			if inst.misalignsAtomics(vars, opts.archs(inst)) {
+				continue candidates
+			}
+			size += totalSize(vars, opts.archs(inst))
+		}
+
+		if bestSize < 0 || size < bestSize {
+			best, bestSize = candidate, size
+		}
+	}
+
+	if best == nil {
+		best = make([]int, len(instances[0].vars()))
+		for i := range best {
+			best[i] = i
+		}
+	}
+
+	var single = true
+	result := make([]Struct, len(instances))
+	for i, inst := range instances {
+		vars := reorder(inst.vars(), best)
+		if totalSize(vars, opts.archs(inst)) > optimal[i] {
+			single = false
+		}
+
+		inst = inst.withHot(opts.Hot)
+		inst.Fields = inst.layout(vars, inst.Arch)
+		result[i] = inst
+	}
+
+	return result, single
+}
+
+// permutation returns the indexes in vars of the fields in the given order.
+func permutation(vars, order []*types.Var) []int {
+	result := make([]int, len(order))
+	for i, v := range order {
+		for j, w := range vars {
+			if sameVar(v, w) {
+				result[i] = j
+				break
+			}
+		}
+	}
+	return result
+}
+
+// reorder returns the fields in the order of the given permutation.
+func reorder(vars []*types.Var, perm []int) []*types.Var {
+	result := make([]*types.Var, len(perm))
+	for i, j := range perm {
+		result[i] = vars[j]
+	}
+	return result
+}
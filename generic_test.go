@@ -0,0 +1,136 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const genericSource = `
+package foo
+
+type Pair[K, V any] struct {
+	A K
+	B V
+	C int32
+	D int16
+}
+
+func (p Pair[K, V]) Swap() Pair[V, K] {
+	return Pair[V, K]{A: p.B, B: p.A}
+}
+
+var (
+	x Pair[int64, int8]
+	y Pair[int8, int64]
+	z Pair[int64, int8]
+)
+`
+
+func TestGenericStructs(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(genericSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(genericSource))
+	require.NoError(err)
+	require.Len(structs, 2)
+
+	require.Equal("Pair[int64, int8]", structs[0].Name)
+	require.Equal("Pair[int8, int64]", structs[1].Name)
+	for _, s := range structs {
+		require.Equal("Pair", s.Generic)
+		require.Equal(Pos{Start: 4, End: 9}, s.Pos)
+		require.Equal(int64(24), s.Size())
+	}
+
+	opts := Options{Archs: []string{"amd64"}}
+	optimized, single := OptimizeGeneric(structs, opts)
+	require.False(single)
+	require.Len(optimized, 2)
+	require.Equal(int64(16), optimized[0].Size())
+	require.Equal(int64(24), optimized[1].Size())
+	require.Equal(
+		[]string{"A", "C", "D", "B"},
+		fieldNames(optimized[1].Fields),
+	)
+
+	optimized, single = OptimizeGeneric(structs[:1], opts)
+	require.True(single)
+	require.Equal(int64(16), optimized[0].Size())
+	require.Equal(`type Pair[K, V any] struct {
+	A K
+	C int32
+	D int16
+	B V
+}`, optimized[0].String())
+}
+
+const genericAtomicSource = `
+package foo
+
+import "sync/atomic"
+
+type Counter[T any] struct {
+	a T //memlayout:first
+	n int64
+	b int32
+}
+
+func (c *Counter[T]) Inc() {
+	atomic.AddInt64(&c.n, 1)
+}
+
+var (
+	x Counter[int32]
+	y Counter[int64]
+)
+`
+
+func TestOptimizeGenericAtomics(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(genericAtomicSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(genericAtomicSource))
+	require.NoError(err)
+	require.Len(structs, 2)
+
+	// Moving b before n aligns n in Counter[int32] on 386, but misaligns
+	// it in Counter[int64], so the order is kept.
+	opts := Options{Archs: []string{"amd64", "386"}}
+	optimized, _ := OptimizeGeneric(structs[:1], opts)
+	require.Equal([]string{"a", "b", "n"}, fieldNames(optimized[0].Fields))
+
+	optimized, _ = OptimizeGeneric(structs, opts)
+	for _, o := range optimized {
+		require.Equal([]string{"a", "n", "b"}, fieldNames(o.Fields), o.Name)
+	}
+}
+
+func fieldNames(fields []Field) []string {
+	var result []string
+	for _, f := range fields {
+		if !f.IsPadding {
+			result = append(result, f.Name)
+		}
+	}
+	return result
+}
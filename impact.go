@@ -0,0 +1,238 @@
+package memlayout
+
+import (
+	"go/types"
+	"sort"
+)
+
+// Impacted is a struct whose layout changed because a type it contains by
+// value changed, although its own declaration did not.
+type Impacted struct {
+	ChangedStruct
+	// File is the path of the file the struct is declared in.
+	File string
+	// Cause is the name of the changed type the struct contains, directly
+	// or through other structs.
+	Cause string
+}
+
+// Impact returns the structs of the package in the given directory, and of
+// the packages of the same module importing it, whose layout is different
+// in the base revision because they contain, directly or transitively, one
+// of the given changed types of the package. The head revision is the one
+// on disk with the given head overlay, if any, and the base revision is
+// the head one with the given base overlay, which has the base content of
+// the changed files. Structs declared in those files changed themselves,
+// so they are not returned.
+func Impact(dir string, head, base map[string][]byte, changed []string, build Build) ([]Impacted, error) {
+	return impact(LoadPackage, dir, head, base, changed, build)
+}
+
+// impact returns the impacted structs like Impact, loading the packages
+// with the given function.
+func impact(load loadFunc, dir string, head, base map[string][]byte, changed []string, build Build) ([]Impacted, error) {
+	pkg, err := load(dir, head, build)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs, err := importers(dir, pkg.Path, build, head)
+	if err != nil {
+		return nil, err
+	}
+
+	var heads = []*Package{pkg}
+	for _, d := range dirs {
+		p, err := load(d, head, build)
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, p)
+	}
+
+	var causes = make(map[string]string)
+	for _, name := range changed {
+		causes[pkg.Path+"."+name] = name
+	}
+	impacted := containers(heads, causes)
+
+	var baseOverlay = make(map[string][]byte, len(head)+len(base))
+	for path, content := range head {
+		baseOverlay[path] = content
+	}
+	for path, content := range base {
+		baseOverlay[path] = content
+	}
+
+	var result []Impacted
+	for _, headPkg := range heads {
+		var basePkg *Package
+		for _, f := range headPkg.Files {
+			filename := headPkg.Fset.File(f.Pos()).Name()
+			if _, ok := base[filename]; ok {
+				continue
+			}
+
+			for _, s := range headPkg.structs(f, build) {
+				cause, ok := impacted[headPkg.Path+"."+s.Name]
+				if !ok || s.local || s.Generic != "" {
+					continue
+				}
+
+				if basePkg == nil {
+					basePkg, err = load(headPkg.Dir, baseOverlay, build)
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				b := basePkg.File(filename)
+				if b == nil {
+					continue
+				}
+
+				for _, bs := range basePkg.structs(b, build) {
+					if bs.Name == s.Name && layoutChanged(bs, s) {
+						bs := bs
+						result = append(result, Impacted{
+							ChangedStruct: ChangedStruct{Base: &bs, Head: s},
+							File:          filename,
+							Cause:         cause,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// layoutChanged reports whether the size or padding of the struct is
+// different in any of the default architectures.
+func layoutChanged(base, head Struct) bool {
+	for _, arch := range DefaultArchs {
+		b, h := base.ForArch(arch), head.ForArch(arch)
+		if b.Size() != h.Size() || b.Padding() != h.Padding() {
+			return true
+		}
+	}
+	return false
+}
+
+// containers returns the package-level struct types of the given packages
+// that contain, directly or transitively, any of the types in causes, with
+// the cause they contain. Types are identified by their package path and
+// name.
+func containers(pkgs []*Package, causes map[string]string) map[string]string {
+	// contained by is the reverse containment graph: the structs that
+	// contain every type by value.
+	var containedBy = make(map[string][]string)
+	for _, pkg := range pkgs {
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() {
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+
+			st, ok := obj.Type().Underlying().(*types.Struct)
+			if !ok {
+				continue
+			}
+
+			container := pkg.Path + "." + name
+			containedTypes(st, func(n *types.Named) {
+				key := typeKey(n)
+				if key != "" {
+					containedBy[key] = append(containedBy[key], container)
+				}
+			})
+		}
+	}
+
+	var queue []string
+	for key := range causes {
+		queue = append(queue, key)
+	}
+	sort.Strings(queue)
+
+	var result = make(map[string]string)
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+
+		cause, ok := causes[key]
+		if !ok {
+			cause = result[key]
+		}
+
+		for _, c := range containedBy[key] {
+			if _, ok := result[c]; ok {
+				continue
+			}
+			if _, ok := causes[c]; ok {
+				continue
+			}
+
+			result[c] = cause
+			queue = append(queue, c)
+		}
+	}
+
+	return result
+}
+
+// containedTypes calls visit for every named type the given type contains
+// by value, that is, not through pointers, slices, maps or other
+// references.
+func containedTypes(typ types.Type, visit func(*types.Named)) {
+	switch t := types.Unalias(typ).(type) {
+	case *types.Named:
+		visit(t)
+	case *types.Array:
+		containedTypes(t.Elem(), visit)
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			containedTypes(t.Field(i).Type(), visit)
+		}
+	}
+}
+
+// typeKey returns the package path and name of the named type, or of its
+// generic type if it is an instantiation, or an empty string for
+// predeclared types.
+func typeKey(n *types.Named) string {
+	obj := n.Origin().Obj()
+	if obj.Pkg() == nil {
+		return ""
+	}
+	return obj.Pkg().Path() + "." + obj.Name()
+}
+
+// importers returns the directories of the packages of the module
+// containing the given directory that import the package with the given
+// path, directly or indirectly, with the given overlay.
+func importers(dir, path string, build Build, overlay map[string][]byte) ([]string, error) {
+	root := moduleRoot(dir, overlay)
+	if root == "" {
+		return nil, nil
+	}
+
+	listed, err := goListAll(root, build, overlay)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, p := range listed {
+		for _, dep := range p.Deps {
+			if dep == path {
+				result = append(result, p.Dir)
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImpact(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod":     "module example.com/root\n",
+		"a/inner.go": "package a\n\ntype Inner struct {\n\tA int32\n\tB int32\n}\n",
+		"a/outer.go": "package a\n\ntype Outer struct {\n\tI Inner\n}\n\ntype Ptr struct {\n\tI *Inner\n}\n",
+		"b/b.go":     "package b\n\nimport \"example.com/root/a\"\n\ntype Wrapper struct {\n\tO [2]a.Outer\n}\n\ntype Other struct {\n\tX int\n}\n",
+		"c/c.go":     "package c\n\ntype Inner struct {\n\tA int32\n}\n",
+	})
+
+	inner := filepath.Join(tmp, "a", "inner.go")
+	base := map[string][]byte{
+		inner: []byte("package a\n\ntype Inner struct {\n\tA int32\n}\n"),
+	}
+
+	impacted, err := Impact(filepath.Join(tmp, "a"), nil, base, []string{"Inner"}, Build{})
+	require.NoError(err)
+	require.Len(impacted, 2)
+
+	var names = make(map[string]Impacted)
+	for _, i := range impacted {
+		names[i.Head.Name] = i
+	}
+
+	outer := names["Outer"]
+	require.Equal(filepath.Join(tmp, "a", "outer.go"), outer.File)
+	require.Equal("Inner", outer.Cause)
+	require.Equal(int64(4), outer.Base.Size())
+	require.Equal(int64(8), outer.Head.Size())
+
+	wrapper := names["Wrapper"]
+	require.Equal(filepath.Join(tmp, "b", "b.go"), wrapper.File)
+	require.Equal("Inner", wrapper.Cause)
+	require.Equal(int64(8), wrapper.Base.Size())
+	require.Equal(int64(16), wrapper.Head.Size())
+}
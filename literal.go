@@ -0,0 +1,37 @@
+package memlayout
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// unkeyedStructs returns the struct types that have composite literals
+// without field keys in the given files, which would not compile anymore if
+// the fields were reordered. Generic structs are returned once for all
+// their instantiations.
+func unkeyedStructs(info *types.Info, files []*ast.File) map[*types.Struct]bool {
+	result := make(map[*types.Struct]bool)
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.CompositeLit)
+			if !ok || len(lit.Elts) == 0 {
+				return true
+			}
+
+			if _, ok := lit.Elts[0].(*ast.KeyValueExpr); ok {
+				return true
+			}
+
+			typ := info.TypeOf(lit)
+			if named, ok := typ.(*types.Named); ok {
+				typ = named.Origin()
+			}
+
+			if s, ok := typ.Underlying().(*types.Struct); ok {
+				result[s] = true
+			}
+			return true
+		})
+	}
+	return result
+}
@@ -0,0 +1,67 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const literalSource = `
+package foo
+
+type Unkeyed struct {
+	A bool
+	B int64
+	C bool
+}
+
+type Keyed struct {
+	A bool
+	B int64
+	C bool
+}
+
+type Pair[T any] struct {
+	A bool
+	B T
+	C bool
+}
+
+var (
+	u = &Unkeyed{true, 1, false}
+	k = Keyed{A: true, B: 1}
+	p = []Pair[int64]{{true, 1, false}}
+	e = Unkeyed{}
+)
+`
+
+func TestUnkeyedLiterals(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod":  "module example.com/foo\n\ngo 1.18\n",
+		"test.go": literalSource,
+	})
+
+	structs, err := StructsFromFile(filepath.Join(tmp, "test.go"), []byte(literalSource))
+	require.NoError(err)
+
+	var keepOrder = make(map[string]bool)
+	for _, s := range structs {
+		keepOrder[s.Name] = s.KeepOrder
+	}
+	require.Equal(map[string]bool{
+		"Unkeyed":     true,
+		"Keyed":       false,
+		"Pair[int64]": true,
+	}, keepOrder)
+}
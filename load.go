@@ -0,0 +1,521 @@
+package memlayout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// Package is a type-checked Go package.
+type Package struct {
+	// Path is the import path of the package.
+	Path string
+	// Dir is the directory containing the package sources.
+	Dir string
+	// Module is the path of the module containing the package, if any.
+	Module string
+	Fset   *token.FileSet
+	Files  []*ast.File
+	Types  *types.Package
+	Info   *types.Info
+	// contents are the contents of the files the package was loaded from.
+	contents map[*ast.File][]byte
+	// readFile reads the files of the package and its dependencies as they
+	// were when it was loaded.
+	readFile func(path string) ([]byte, error)
+	// XTest is the external test package of the package, if it has one
+	// and it could be loaded, or else xtestErr is the error loading it.
+	XTest    *Package
+	xtestErr error
+	// deps are the dependencies of the package that may change.
+	deps packageDeps
+}
+
+// packageDeps are the dependencies of a package that may change: the
+// directories of the packages it imports, directly or indirectly, that are
+// not in the standard library or the module cache, and the files defining
+// their modules.
+type packageDeps struct {
+	dirs     []string
+	modFiles []string
+}
+
+// inModule reports whether the package with the given import path is the
+// package itself or another one of its module.
+func (p *Package) inModule(path string) bool {
+	return path == p.Path || inModule(path, p.Module)
+}
+
+// File returns the syntax tree of the file of the package with the given
+// path, or nil if the package does not contain such file.
+func (p *Package) File(filename string) *ast.File {
+	for _, f := range p.Files {
+		if samePath(p.Fset.File(f.Pos()).Name(), filename) {
+			return f
+		}
+	}
+	return nil
+}
+
+// listedPackage is a package as reported by `go list -json`.
+type listedPackage struct {
+	ImportPath string
+	Dir        string
+	Name       string
+	// ForTest is the import path of the package whose tests the package
+	// is built for, if it is a test variant.
+	ForTest   string
+	Export    string
+	GoFiles   []string
+	CgoFiles  []string
+	ImportMap map[string]string
+	Standard  bool
+	Module    *listedModule
+	Deps      []string
+	// IgnoredGoFiles are the files excluded by build constraints.
+	IgnoredGoFiles []string
+	Error          *struct{ Err string }
+}
+
+// listedModule is the module of a package as reported by `go list -json`.
+type listedModule struct {
+	Path  string
+	Dir   string
+	GoMod string
+	// Main reports whether it is the main module, or one of the modules of
+	// the workspace.
+	Main bool
+}
+
+// excludedError is returned when a build configuration excludes all the
+// files of a package.
+type excludedError struct {
+	dir   string
+	build Build
+}
+
+func (e *excludedError) Error() string {
+	return fmt.Sprintf("build %s excludes all Go files in %s", e.build, e.dir)
+}
+
+// LoadPackage loads and type-checks the package in the given directory for
+// the given build configuration. Packages are resolved by the go command
+// using the module containing the directory, so go.mod, replace
+// directives, go.work files and nested modules are respected. If the
+// module has a vendor directory, it is used. Nothing is downloaded from
+// the network. Directories outside of any module are loaded in GOPATH
+// mode.
+//
+// Only the package itself is type-checked from source; its dependencies
+// are imported from the export data produced by the go command. The given
+// overlay replaces the content of files on disk, or adds files that do not
+// exist, for the package and its dependencies, and files with nil content
+// in it are removed. The directory of the package, its go.mod and the
+// packages of its module may exist only in the overlay, as long as some
+// parent directory of the package exists on disk.
+//
+// The test files of the package are type-checked along with it, and the
+// ones of its external test package, if any, are loaded as XTest.
+func LoadPackage(dir string, overlay map[string][]byte, build Build) (*Package, error) {
+	listed, err := goList(dir, build, overlay)
+	if err != nil {
+		return nil, err
+	}
+
+	// The package in the directory is type-checked with its test files,
+	// as go vet does, and the external test package on its own.
+	target, test, xtest := rootPackages(listed)
+	checked := target
+	if test != nil {
+		checked = *test
+	}
+
+	if len(checked.GoFiles) == 0 && len(checked.CgoFiles) == 0 && len(checked.IgnoredGoFiles) > 0 {
+		return nil, &excludedError{dir: dir, build: build}
+	}
+
+	if checked.Error != nil && len(checked.GoFiles) == 0 {
+		return nil, fmt.Errorf("unable to load package in %s: %s", dir, checked.Error.Err)
+	}
+
+	var module string
+	if target.Module != nil {
+		module = target.Module.Path
+	}
+
+	var deps packageDeps
+	var seen = make(map[string]bool)
+	for _, p := range listed {
+		if p.Standard || (p.Module != nil && !p.Module.Main) {
+			continue
+		}
+
+		if p.Dir != target.Dir && !seen[p.Dir] {
+			seen[p.Dir] = true
+			deps.dirs = append(deps.dirs, p.Dir)
+		}
+		if p.Module != nil && !seen[p.Module.GoMod] {
+			seen[p.Module.GoMod] = true
+			deps.modFiles = append(deps.modFiles, p.Module.GoMod, filepath.Join(p.Module.Dir, "vendor", "modules.txt"))
+		}
+	}
+
+	fset := token.NewFileSet()
+	gcImporter := exportImporter(fset, listed)
+	readFile := func(path string) ([]byte, error) {
+		if content, ok := overlay[path]; ok {
+			if content == nil {
+				return nil, os.ErrNotExist
+			}
+			return content, nil
+		}
+		return ioutil.ReadFile(path)
+	}
+
+	pkg, err := checkPackage(checked, target.ImportPath, fset, readFile, gcImporter.Import)
+	if err != nil {
+		return nil, err
+	}
+	pkg.Module = module
+	pkg.deps = deps
+
+	if xtest != nil {
+		// The external test package imports the package with its test
+		// files.
+		pkg.XTest, pkg.xtestErr = checkPackage(*xtest, target.ImportPath+"_test", fset, readFile, func(path string) (*types.Package, error) {
+			if path == checked.ImportPath {
+				return pkg.Types, nil
+			}
+			return gcImporter.Import(path)
+		})
+		if pkg.XTest != nil {
+			pkg.XTest.Module = module
+			pkg.XTest.deps = deps
+		}
+	}
+
+	return pkg, nil
+}
+
+// rootPackages returns the package listed by `go list -deps -test` for a
+// directory, and its test variant with the test files and its external
+// test package, if it has any.
+func rootPackages(listed []listedPackage) (listedPackage, *listedPackage, *listedPackage) {
+	// The package in the directory is the last one, as go list prints
+	// dependencies first, unless it has tests, which are printed after it.
+	target := listed[len(listed)-1]
+	for _, p := range listed {
+		if p.ForTest != "" {
+			for _, q := range listed {
+				if q.ImportPath == p.ForTest {
+					target = q
+				}
+			}
+			break
+		}
+	}
+
+	var test, xtest *listedPackage
+	for i, p := range listed {
+		switch p.ImportPath {
+		case target.ImportPath + " [" + target.ImportPath + ".test]":
+			test = &listed[i]
+		case target.ImportPath + "_test [" + target.ImportPath + ".test]":
+			xtest = &listed[i]
+		}
+	}
+	return target, test, xtest
+}
+
+// checkPackage parses and type-checks the files of the given listed
+// package, read with the given function, as the package with the given
+// import path. Its imports are resolved with its import map and the given
+// function.
+func checkPackage(
+	listed listedPackage,
+	importPath string,
+	fset *token.FileSet,
+	readFile func(path string) ([]byte, error),
+	importFunc importerFunc,
+) (*Package, error) {
+	var files []*ast.File
+	var contents = make(map[*ast.File][]byte)
+	for _, name := range append(listed.GoFiles, listed.CgoFiles...) {
+		path := filepath.Join(listed.Dir, name)
+		content, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		f, err := parser.ParseFile(fset, path, content, parser.ParseComments)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse file %s: %s", path, err)
+		}
+		files = append(files, f)
+		contents[f] = content
+	}
+
+	info := &types.Info{
+		Types:      make(map[ast.Expr]types.TypeAndValue),
+		Defs:       make(map[*ast.Ident]types.Object),
+		Uses:       make(map[*ast.Ident]types.Object),
+		Selections: make(map[*ast.SelectorExpr]*types.Selection),
+		Instances:  make(map[*ast.Ident]types.Instance),
+	}
+
+	var typeErrs []error
+	conf := types.Config{
+		Importer: importerFunc(func(path string) (*types.Package, error) {
+			if mapped, ok := listed.ImportMap[path]; ok {
+				path = mapped
+			}
+			return importFunc(path)
+		}),
+		FakeImportC: true,
+		Error:       func(err error) { typeErrs = append(typeErrs, err) },
+	}
+
+	// Fields of types that could not be resolved would be laid out as if
+	// they were a word, so no layout is better than a wrong one.
+	pkg, _ := conf.Check(importPath, fset, files, info)
+	if len(typeErrs) > 0 {
+		return nil, fmt.Errorf("unable to type-check package in %s: %s", listed.Dir, typeErrs[0])
+	}
+
+	return &Package{
+		Path:     importPath,
+		Dir:      listed.Dir,
+		Fset:     fset,
+		Files:    files,
+		Types:    pkg,
+		Info:     info,
+		contents: contents,
+		readFile: readFile,
+	}, nil
+}
+
+// writeOverlay writes the given overlay to a temporary directory for the
+// -overlay flag of the go command, and returns the flag and a function to
+// remove the directory.
+func writeOverlay(overlay map[string][]byte) (string, func(), error) {
+	tmp, err := ioutil.TempDir(os.TempDir(), "memlayout-overlay")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+
+	var replace = make(map[string]string)
+	var i int
+	for path, content := range overlay {
+		if content == nil {
+			replace[path] = ""
+			continue
+		}
+
+		replace[path] = filepath.Join(tmp, fmt.Sprintf("%d.go", i))
+		if err := ioutil.WriteFile(replace[path], content, 0644); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		i++
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"Replace": replace})
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	file := filepath.Join(tmp, "overlay.json")
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	return "-overlay=" + file, cleanup, nil
+}
+
+// exportImporter returns an importer of the given packages from their
+// export data.
+func exportImporter(fset *token.FileSet, listed []listedPackage) types.Importer {
+	exports := make(map[string]string)
+	for _, p := range listed {
+		exports[p.ImportPath] = p.Export
+	}
+
+	return importer.ForCompiler(fset, "gc", func(path string) (io.ReadCloser, error) {
+		export, ok := exports[path]
+		if !ok || export == "" {
+			return nil, fmt.Errorf("no export data for package %s", path)
+		}
+		return os.Open(export)
+	})
+}
+
+type importerFunc func(path string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+// goList lists the package in the given directory, its test variants and
+// all their dependencies for the given build configuration and overlay,
+// with their export data.
+func goList(dir string, build Build, overlay map[string][]byte) ([]listedPackage, error) {
+	return runGoList(dir, ".", build, overlay, []string{
+		"-export", "-deps", "-test",
+		"-json=ImportPath,Dir,Name,ForTest,Export,GoFiles,CgoFiles,IgnoredGoFiles,ImportMap,Standard,Module,Error",
+	})
+}
+
+// goListAll lists the packages in the given directory and its
+// subdirectories, with their dependencies, for the given build
+// configuration and overlay.
+func goListAll(dir string, build Build, overlay map[string][]byte) ([]listedPackage, error) {
+	return runGoList(dir, "./...", build, overlay, []string{"-json=ImportPath,Dir,Name,Deps,Error"})
+}
+
+// runGoList runs `go list` for the given pattern, relative to the given
+// directory, with the given arguments and returns the packages it prints.
+func runGoList(dir, pattern string, build Build, overlay map[string][]byte, args []string) ([]listedPackage, error) {
+	args = append([]string{"list", "-e"}, append(build.flags(), args...)...)
+	if len(overlay) > 0 {
+		flag, cleanup, err := writeOverlay(overlay)
+		if err != nil {
+			return nil, err
+		}
+		defer cleanup()
+		args = append(args, flag)
+	}
+
+	cwd, pattern := listDir(dir, pattern)
+	args = append(args, pattern)
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = cwd
+	cmd.Env = append(os.Environ(), goEnv(dir, overlay)...)
+	cmd.Env = append(cmd.Env, build.env()...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("go list failed in %s: %s: %s", dir, err, stderr.String())
+	}
+
+	var result []listedPackage
+	dec := json.NewDecoder(&stdout)
+	for {
+		var p listedPackage
+		err := dec.Decode(&p)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode go list output: %s", err)
+		}
+		result = append(result, p)
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no packages found in %s", dir)
+	}
+
+	return result, nil
+}
+
+// listDir returns the directory the go command has to be run in to list
+// the given pattern, relative to the given directory, and the pattern
+// relative to it. The directory may exist only in an overlay, in which
+// case the command is run in its closest parent that exists on disk.
+func listDir(dir, pattern string) (string, string) {
+	cwd := dir
+	for {
+		if fi, err := os.Stat(cwd); err == nil && fi.IsDir() {
+			break
+		}
+
+		parent := filepath.Dir(cwd)
+		if parent == cwd {
+			break
+		}
+		cwd = parent
+	}
+
+	if cwd == dir {
+		return dir, pattern
+	}
+
+	rel, err := filepath.Rel(cwd, dir)
+	if err != nil {
+		return dir, pattern
+	}
+	return cwd, "./" + path.Join(filepath.ToSlash(rel), pattern)
+}
+
+// goEnv returns the environment the go command has to be run with to load
+// the package in the given directory, with the given overlay, without
+// using the network. GOFLAGS is always set, as the go command cannot
+// update a go.mod file that is in the overlay, so -mod=mod in the
+// environment would make it fail.
+func goEnv(dir string, overlay map[string][]byte) []string {
+	env := []string{"GOPROXY=off"}
+
+	root := moduleRoot(dir, overlay)
+	if root == "" {
+		return append(env, "GO111MODULE=off", "GOFLAGS=")
+	}
+
+	env = append(env, "GO111MODULE=on")
+	if exists(filepath.Join(root, "vendor", "modules.txt"), overlay) {
+		return append(env, "GOFLAGS=-mod=vendor")
+	}
+	return append(env, "GOFLAGS=-mod=readonly")
+}
+
+// moduleRoot returns the root directory of the module containing the given
+// directory, or an empty string if it is not inside a module. The go.mod
+// file of the module may be in the given overlay.
+func moduleRoot(dir string, overlay map[string][]byte) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+
+	for {
+		if exists(filepath.Join(dir, "go.mod"), overlay) {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// exists reports whether the file with the given path is in the overlay or
+// on disk, and not removed by the overlay.
+func exists(path string, overlay map[string][]byte) bool {
+	if content, ok := overlay[path]; ok {
+		return content != nil
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func samePath(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
@@ -0,0 +1,157 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPackage(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod":          "module example.com/root\n\nrequire example.com/dep v0.0.0\n\nreplace example.com/dep => ./dep\n",
+		"dep/go.mod":      "module example.com/dep\n",
+		"dep/dep.go":      "package dep\n\ntype T struct {\n\tA int64\n}\n",
+		"a/a.go":          "package a\n\nimport \"example.com/dep\"\n\ntype S struct {\n\tB bool\n\tT dep.T\n}\n",
+		"a/a_test.go":     "package a_test\n\ntype X struct{}\n",
+		"a/nested/go.mod": "module example.com/nested\n",
+		"a/nested/n.go":   "package nested\n\ntype N struct{}\n",
+	})
+
+	pkg, err := LoadPackage(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	require.Equal("example.com/root/a", pkg.Path)
+	require.Len(pkg.Files, 1)
+	require.NotNil(pkg.Types.Scope().Lookup("S"))
+	require.Nil(pkg.Types.Scope().Lookup("X"))
+
+	structs, err := StructsFromFile(filepath.Join(tmp, "a", "a.go"), []byte(
+		"package a\n\nimport \"example.com/dep\"\n\ntype S struct {\n\tB bool\n\tT dep.T\n\tC bool\n}\n",
+	))
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal(int64(24), structs[0].Size())
+
+	// Files in the overlay are used by the dependencies and can be new.
+	pkg, err = LoadPackage(filepath.Join(tmp, "a"), map[string][]byte{
+		filepath.Join(tmp, "dep", "dep.go"): []byte("package dep\n\ntype T struct {\n\tA int32\n}\n"),
+		filepath.Join(tmp, "a", "new.go"):   []byte("package a\n\ntype New struct{}\n"),
+	}, Build{})
+	require.NoError(err)
+	require.Len(pkg.Files, 2)
+	require.NotNil(pkg.File(filepath.Join(tmp, "a", "new.go")))
+	require.Equal(int64(8), sizesFor(DefaultArch).Sizeof(pkg.Types.Scope().Lookup("S").Type()))
+
+	// Files with nil content in the overlay are removed.
+	pkg, err = LoadPackage(filepath.Join(tmp, "a"), map[string][]byte{
+		filepath.Join(tmp, "a", "a.go"):   nil,
+		filepath.Join(tmp, "a", "new.go"): []byte("package a\n\ntype New struct{}\n"),
+	}, Build{})
+	require.NoError(err)
+	require.Len(pkg.Files, 1)
+	require.Nil(pkg.Types.Scope().Lookup("S"))
+
+	pkg, err = LoadPackage(filepath.Join(tmp, "a", "nested"), nil, Build{})
+	require.NoError(err)
+	require.Equal("example.com/nested", pkg.Path)
+
+	// Types that cannot be resolved have no layout.
+	_, err = StructsFromFile(filepath.Join(tmp, "a", "a.go"), []byte(
+		"package a\n\nimport \"example.com/missing\"\n\ntype S struct {\n\tB bool\n\tM missing.M\n\tC bool\n}\n",
+	))
+	require.Error(err)
+	require.Contains(err.Error(), "example.com/missing")
+}
+
+func TestLoadPackageOverlayModule(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	// The go command cannot update a go.mod in the overlay, so GOFLAGS of
+	// the environment must not be used.
+	t.Setenv("GOFLAGS", "-mod=mod")
+
+	pkg, err := LoadPackage(filepath.Join(tmp, "a"), map[string][]byte{
+		filepath.Join(tmp, "go.mod"):    []byte("module example.com/root\n"),
+		filepath.Join(tmp, "a", "a.go"): []byte("package a\n\ntype S struct {\n\tA bool\n}\n"),
+	}, Build{})
+	require.NoError(err)
+	require.Equal("example.com/root/a", pkg.Path)
+}
+
+func TestLoadPackageTests(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod":      "module example.com/root\n",
+		"a/a.go":      "package a\n\ntype S struct {\n\tA int64\n}\n",
+		"a/a_test.go": "package a\n\nimport \"testing\"\n\ntype In struct {\n\tB bool\n\tS S\n\tC bool\n}\n\nfunc TestIn(t *testing.T) {}\n",
+		"a/x_test.go": "package a_test\n\nimport \"example.com/root/a\"\n\ntype Out struct {\n\tB bool\n\tI a.In\n}\n",
+		"b/b.go":      "package b\n",
+		"b/b_test.go": "package b_test\n\nimport \"example.com/missing\"\n\nvar _ missing.M\n",
+		"c/c_test.go": "package c\n\ntype OnlyTest struct {\n\tB bool\n}\n",
+	})
+
+	// Test files are type-checked with the package, and external tests as
+	// their own package that can use them.
+	pkg, err := LoadPackage(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	require.Equal("example.com/root/a", pkg.Path)
+	require.Len(pkg.Files, 2)
+	require.NotNil(pkg.Types.Scope().Lookup("In"))
+	require.NotNil(pkg.XTest)
+	require.Equal("example.com/root/a_test", pkg.XTest.Path)
+	require.NotNil(pkg.XTest.Types.Scope().Lookup("Out"))
+
+	for name, size := range map[string]int64{"a_test.go": 24, "x_test.go": 32} {
+		path := filepath.Join(tmp, "a", name)
+		content, err := ioutil.ReadFile(path)
+		require.NoError(err)
+
+		structs, err := StructsForBuild(path, content, Build{GOOS: "linux", GOARCH: "amd64"})
+		require.NoError(err, name)
+		require.Len(structs, 1, name)
+		require.Equal(size, structs[0].Size(), name)
+	}
+
+	// External tests that cannot be loaded only fail their own files.
+	pkg, err = LoadPackage(filepath.Join(tmp, "b"), nil, Build{})
+	require.NoError(err)
+	require.Nil(pkg.XTest)
+	_, err = StructsFromFile(filepath.Join(tmp, "b", "b_test.go"), []byte("package b_test\n\nimport \"example.com/missing\"\n\nvar _ missing.M\n"))
+	require.Error(err)
+
+	structs, err := StructsFromFile(filepath.Join(tmp, "c", "c_test.go"), []byte("package c\n\ntype OnlyTest struct {\n\tB bool\n}\n"))
+	require.NoError(err)
+	require.Len(structs, 1)
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+}
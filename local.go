@@ -0,0 +1,175 @@
+package memlayout
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// localStruct is a struct type expression that is not the declaration of a
+// package-level type, such as a type declared inside a function or an
+// anonymous struct.
+type localStruct struct {
+	// name is the name of the type, or of the innermost variable, field or
+	// type the anonymous struct is part of, qualified with the name of the
+	// function it is in, if any.
+	name string
+	st   *ast.StructType
+	// spec is the declaration of the type, or nil if it is anonymous.
+	spec *ast.TypeSpec
+	docs []*ast.CommentGroup
+}
+
+// localStructs returns the struct type expressions of the file that are
+// not package-level type declarations, in source order. Structs nested in
+// another struct are part of it, so they are not returned.
+func localStructs(f *ast.File) []localStruct {
+	var result []localStruct
+	var stack []ast.Node
+	ast.Inspect(f, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+
+		st, ok := n.(*ast.StructType)
+		if !ok {
+			stack = append(stack, n)
+			return true
+		}
+
+		parent := stack[len(stack)-1]
+		fn := enclosingFunc(stack)
+		if spec, ok := parent.(*ast.TypeSpec); ok && spec.Type == st {
+			if fn != "" {
+				decl := stack[len(stack)-2].(*ast.GenDecl)
+				result = append(result, localStruct{
+					name: fn + "." + spec.Name.Name,
+					st:   st,
+					spec: spec,
+					docs: specDocs(decl, spec.Doc),
+				})
+			}
+			return false
+		}
+
+		name, docs := anonymousContext(stack)
+		if fn != "" {
+			name = fn + "." + name
+		}
+
+		result = append(result, localStruct{name: name, st: st, docs: docs})
+		return false
+	})
+	return result
+}
+
+// enclosingFunc returns the name of the innermost function declaration in
+// the stack of nodes, or an empty string if there is none.
+func enclosingFunc(stack []ast.Node) string {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if fn, ok := stack[i].(*ast.FuncDecl); ok {
+			return fn.Name.Name
+		}
+	}
+	return ""
+}
+
+// anonymousContext returns the name of the innermost variable, field or type in the
+// stack of nodes an anonymous struct is part of, and its doc comments.
+func anonymousContext(stack []ast.Node) (string, []*ast.CommentGroup) {
+	for i := len(stack) - 1; i >= 0; i-- {
+		switch n := stack[i].(type) {
+		case *ast.ValueSpec:
+			return n.Names[0].Name, specDocs(stack[i-1].(*ast.GenDecl), n.Doc)
+		case *ast.TypeSpec:
+			return n.Name.Name, specDocs(stack[i-1].(*ast.GenDecl), n.Doc)
+		case *ast.AssignStmt:
+			if ident, ok := n.Lhs[0].(*ast.Ident); ok {
+				return ident.Name, nil
+			}
+		case *ast.Field:
+			if len(n.Names) > 0 {
+				return n.Names[0].Name, []*ast.CommentGroup{n.Doc}
+			}
+		case *ast.FuncDecl, *ast.FuncLit:
+			return "struct", nil
+		}
+	}
+	return "struct", nil
+}
+
+// sharedAnonymous returns the anonymous struct types of the given files
+// whose identity is shared with other code, which reordering their fields
+// would break, as it changes their type: the ones of function parameters
+// and results and of exported variables, which other code may pass values
+// of identical types to, and the ones identical to another struct type of
+// the files, which their values may be assigned or converted to.
+func sharedAnonymous(info *types.Info, files []*ast.File) map[*ast.StructType]bool {
+	var anonymous []*ast.StructType
+	var all []*types.Struct
+	result := make(map[*ast.StructType]bool)
+	for _, f := range files {
+		var stack []ast.Node
+		ast.Inspect(f, func(n ast.Node) bool {
+			if n == nil {
+				stack = stack[:len(stack)-1]
+				return true
+			}
+
+			if st, ok := n.(*ast.StructType); ok {
+				if s, ok := info.TypeOf(st).(*types.Struct); ok {
+					all = append(all, s)
+				}
+
+				if spec, ok := stack[len(stack)-1].(*ast.TypeSpec); !ok || spec.Type != st {
+					anonymous = append(anonymous, st)
+					result[st] = sharedContext(stack)
+				}
+			}
+
+			stack = append(stack, n)
+			return true
+		})
+	}
+
+	for _, st := range anonymous {
+		s, ok := info.TypeOf(st).(*types.Struct)
+		if !ok {
+			continue
+		}
+
+		for _, other := range all {
+			if other != s && types.Identical(other, s) {
+				result[st] = true
+				break
+			}
+		}
+	}
+	return result
+}
+
+// sharedContext reports whether an anonymous struct in the given stack of
+// nodes is part of a function signature or of the type of an exported
+// package-level variable.
+func sharedContext(stack []ast.Node) bool {
+	for i := len(stack) - 1; i >= 0; i-- {
+		switch n := stack[i].(type) {
+		case *ast.FuncType:
+			return true
+		case *ast.BlockStmt:
+			return false
+		case *ast.ValueSpec:
+			if i != 2 {
+				return false
+			}
+
+			for _, name := range n.Names {
+				if name.IsExported() {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const localSource = `
+package foo
+
+type Named struct {
+	A bool
+	B struct {
+		C bool
+		D int64
+	}
+}
+
+// config is global.
+//memlayout:keep-order
+var config struct {
+	Debug bool
+	Port  int64
+	Quiet bool
+}
+
+var index map[string]struct {
+	Seen  bool
+	Count int64
+	Last  bool
+}
+
+func Run() {
+	type local struct {
+		A bool
+		B int64
+		C bool
+	}
+
+	cases := []struct {
+		name  string
+		ok    bool
+		value int32
+	}{
+		{"a", true, 1},
+	}
+
+	var done chan struct{}
+	_, _, _ = local{}, cases, done
+}
+`
+
+func TestLocalStructs(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(localSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(localSource))
+	require.NoError(err)
+
+	var names []string
+	var positions []Pos
+	for _, s := range structs {
+		names = append(names, s.Name)
+		positions = append(positions, s.Pos)
+	}
+	require.Equal([]string{"Named", "config", "index", "Run.local", "Run.cases"}, names)
+	require.Equal([]Pos{
+		{Start: 4, End: 10},
+		{Start: 14, End: 18},
+		{Start: 20, End: 24},
+		{Start: 27, End: 31},
+		{Start: 33, End: 37},
+	}, positions)
+
+	require.True(structs[1].KeepOrder)
+	require.False(structs[2].KeepOrder)
+
+	require.Equal(int64(24), structs[2].Size())
+	optimized := Optimize(structs[2])
+	require.Equal(int64(16), optimized.Size())
+	require.Equal(`struct {
+	Count int64
+	Last  bool
+	Seen  bool
+}`, optimized.String())
+
+	require.Equal(`type local struct {
+	B int64
+	A bool
+	C bool
+}`, Optimize(structs[3]).String())
+
+	// The rows of the table use unkeyed literals, which reordering the
+	// fields would break.
+	require.True(structs[4].KeepOrder)
+	require.Equal(int64(24), structs[4].Size())
+	require.Equal(`struct {
+	name  string
+	ok    bool
+	value int32
+}`, Optimize(structs[4]).String())
+}
+
+const sharedSource = `
+package foo
+
+var Defaults struct {
+	Debug bool
+	Port  int64
+	Quiet bool
+}
+
+func Handle(opts struct {
+	Debug bool
+	Port  int64
+	Quiet bool
+}) {
+	var prev struct {
+		A bool
+		B int64
+		C bool
+	}
+
+	var next struct {
+		A bool
+		B int64
+		C bool
+	}
+
+	var stats struct {
+		X bool
+		Y int64
+		Z bool
+	}
+
+	prev = next
+	_, _, _ = prev, stats, opts
+}
+`
+
+func TestLocalStructsSharedIdentity(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(sharedSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(sharedSource))
+	require.NoError(err)
+
+	keepOrder := make(map[string]bool)
+	for _, s := range structs {
+		keepOrder[s.Name] = s.KeepOrder
+	}
+
+	// The identity of anonymous struct types depends on their field order,
+	// so only the ones no other code can refer to may be reordered.
+	require.Equal(map[string]bool{
+		"Defaults":     true,
+		"Handle.opts":  true,
+		"Handle.prev":  true,
+		"Handle.next":  true,
+		"Handle.stats": false,
+	}, keepOrder)
+}
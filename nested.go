@@ -0,0 +1,247 @@
+package memlayout
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+)
+
+// withNested returns the struct with the fields of its nested anonymous
+// structs optimized with the given options. Their fields are replaced with
+// new ones of the optimized struct types.
+func (s Struct) withNested(opts Options) Struct {
+	fields := make([]Field, len(s.Fields))
+	copy(fields, s.Fields)
+	for i, f := range fields {
+		if f.IsPadding || len(f.Children) == 0 {
+			continue
+		}
+
+		typ, ok := f.field.Type().(*types.Struct)
+		if !ok {
+			continue
+		}
+
+		nested := Struct{Name: s.Name + "." + f.Name, Arch: s.Arch, Fields: f.Children}
+		nested = OptimizeWith(nested, Options{Archs: opts.archs(s), PtrData: opts.PtrData})
+
+		vars := nested.vars()
+		fields[i].field = types.NewField(
+			f.field.Pos(), f.field.Pkg(), f.field.Name(),
+			types.NewStruct(vars, tagsOf(typ, vars)), f.field.Embedded(),
+		)
+		fields[i].Children = nested.Fields
+	}
+
+	s.Fields = fields
+	return s
+}
+
+// tagsOf returns the tags in the struct of the given fields.
+func tagsOf(typ *types.Struct, vars []*types.Var) []string {
+	tags := make([]string, len(vars))
+	for i, v := range vars {
+		for j := 0; j < typ.NumFields(); j++ {
+			if sameVar(typ.Field(j), v) {
+				tags[i] = typ.Tag(j)
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// ElementSaving is the memory that would be saved in a field by optimizing
+// the named struct type it holds, either directly or as the element of an
+// array. That type cannot be changed in the struct itself.
+type ElementSaving struct {
+	Field Field
+	// Type is the name of the struct type of the elements.
+	Type string
+	// Count is the number of elements in the field.
+	Count int64
+	// PerElement is the number of bytes saved in each element.
+	PerElement int64
+}
+
+// Total returns the number of bytes saved in the whole field.
+func (e ElementSaving) Total() int64 {
+	return e.Count * e.PerElement
+}
+
+// ElementSavings returns the fields of the struct holding named struct types
+// whose layout could be improved, with how much it would save. Only the
+// types declared in the module of the struct are taken into account, as
+// the others cannot be changed along with it, and the ones that must keep
+// their field order are skipped.
+func ElementSavings(s Struct) []ElementSaving {
+	var result []ElementSaving
+	for _, f := range s.Fields {
+		if f.IsPadding || f.field == nil || f.elem == nil {
+			continue
+		}
+
+		named, count := elementType(f.field.Type())
+		if named == nil || count == 0 {
+			continue
+		}
+
+		st, ok := named.Underlying().(*types.Struct)
+		if !ok {
+			continue
+		}
+
+		elem := Struct{Name: named.Obj().Name(), Arch: s.Arch, Fields: Fields(st, s.Arch), src: f.elem.src}
+		elem.setNodes()
+		applyStructDirectives(&elem, f.elem.docs)
+		if elem.Ignore || elem.KeepOrder || f.elem.unkeyed {
+			continue
+		}
+
+		saved := elem.Size() - Optimize(elem).Size()
+		if saved > 0 {
+			result = append(result, ElementSaving{
+				Field:      f,
+				Type:       types.TypeString(named, qualifier(f.field.Pkg())),
+				Count:      count,
+				PerElement: saved,
+			})
+		}
+	}
+	return result
+}
+
+// elementType returns the named type held by a field of the given type,
+// either directly or as the element of an array, and the number of
+// elements. It returns nil if the type is not a named type or an array of
+// them.
+func elementType(typ types.Type) (*types.Named, int64) {
+	count := int64(1)
+	for {
+		arr, ok := typ.(*types.Array)
+		if !ok {
+			break
+		}
+		typ, count = arr.Elem(), count*arr.Len()
+	}
+
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return nil, 0
+	}
+	return named, count
+}
+
+// elementDecl is the declaration of the named struct type held by a field.
+type elementDecl struct {
+	src  *source
+	docs []*ast.CommentGroup
+	// unkeyed reports whether the type has composite literals without field
+	// keys in the package of the field.
+	unkeyed bool
+}
+
+// setElementDecls sets the declarations of the named struct types held by
+// the given fields, if they are in the module of the package. The
+// declarations already found are kept in decls.
+func (pkg *Package) setElementDecls(
+	fields []Field,
+	unkeyed map[*types.Struct]bool,
+	decls map[*types.TypeName]*elementDecl,
+) {
+	for i, f := range fields {
+		if f.IsPadding || f.field == nil {
+			continue
+		}
+
+		named, _ := elementType(f.field.Type())
+		if named == nil {
+			continue
+		}
+
+		origin := named.Origin()
+		obj := origin.Obj()
+		decl, ok := decls[obj]
+		if !ok {
+			decl = pkg.elementDecl(obj)
+			if st, ok := origin.Underlying().(*types.Struct); ok && decl != nil {
+				decl.unkeyed = unkeyed[st]
+			}
+			decls[obj] = decl
+		}
+		fields[i].elem = decl
+	}
+}
+
+// elementDecl returns the declaration of the given named struct type, or
+// nil if it is not declared in the module of the package or its source
+// cannot be found.
+func (pkg *Package) elementDecl(obj *types.TypeName) *elementDecl {
+	if obj.Pkg() == nil || !pkg.inModule(obj.Pkg().Path()) {
+		return nil
+	}
+
+	pos := pkg.Fset.Position(obj.Pos())
+	var fset *token.FileSet
+	var file *ast.File
+	var content []byte
+	if obj.Pkg() == pkg.Types {
+		fset = pkg.Fset
+		for _, f := range pkg.Files {
+			if fset.File(f.Pos()).Name() == pos.Filename {
+				file, content = f, pkg.contents[f]
+			}
+		}
+	} else if pkg.readFile != nil {
+		// Other packages are imported from their export data, which only
+		// has the positions of their declarations.
+		var err error
+		content, err = pkg.readFile(pos.Filename)
+		if err != nil {
+			return nil
+		}
+
+		fset = token.NewFileSet()
+		file, err = parser.ParseFile(fset, pos.Filename, content, parser.ParseComments)
+		if err != nil {
+			return nil
+		}
+	}
+
+	if file == nil {
+		return nil
+	}
+
+	var result *elementDecl
+	ast.Inspect(file, func(n ast.Node) bool {
+		decl, ok := n.(*ast.GenDecl)
+		if !ok || result != nil {
+			return result == nil
+		}
+
+		for _, spec := range decl.Specs {
+			ts, ok := spec.(*ast.TypeSpec)
+			if !ok || ts.Name.Name != obj.Name() || fset.Position(ts.Name.Pos()).Line != pos.Line {
+				continue
+			}
+
+			if src := newSource(fset, content, ts); src != nil {
+				result = &elementDecl{src: src, docs: specDocs(decl, ts.Doc)}
+			}
+		}
+		return false
+	})
+	return result
+}
+
+// qualifier qualifies the types of other packages than the given one with
+// their package name, as they are written in the source code.
+func qualifier(pkg *types.Package) types.Qualifier {
+	return func(p *types.Package) string {
+		if p == pkg {
+			return ""
+		}
+		return p.Name()
+	}
+}
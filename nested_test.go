@@ -0,0 +1,139 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const nestedSource = `
+package foo
+
+type entry struct {
+	used bool
+	key  int64
+	gen  bool
+}
+
+type Table struct {
+	name    string
+	entries [256]entry
+	// stats of the table.
+	stats struct {
+		hits   bool
+		total  int64 ` + "`json:\"total\"`" + `
+		misses bool
+	}
+	last entry
+}
+`
+
+func TestNestedStructs(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(nestedSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(nestedSource))
+	require.NoError(err)
+	require.Len(structs, 2)
+
+	table := structs[0]
+	require.Equal("Table", table.Name)
+	require.Equal(int64(6208), table.Size())
+
+	optimized := Optimize(table)
+	require.Equal(int64(6200), optimized.Size())
+	require.Equal(`type Table struct {
+	entries [256]entry
+	last    entry
+	name    string
+	// stats of the table.
+	stats struct {
+		total  int64 `+"`json:\"total\"`"+`
+		hits   bool
+		misses bool
+	}
+}`, optimized.String())
+
+	savings := ElementSavings(table)
+	require.Len(savings, 2)
+
+	require.Equal("entries", savings[0].Field.Name)
+	require.Equal("entry", savings[0].Type)
+	require.Equal(int64(256), savings[0].Count)
+	require.Equal(int64(8), savings[0].PerElement)
+	require.Equal(int64(2048), savings[0].Total())
+
+	require.Equal("last", savings[1].Field.Name)
+	require.Equal(int64(1), savings[1].Count)
+	require.Equal(int64(8), savings[1].Total())
+
+	require.Len(ElementSavings(Optimize(structs[1])), 0)
+}
+
+func TestElementSavingsDeclarations(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	const wasteful = "struct {\n\tA bool\n\tB int64\n\tC bool\n}\n"
+	const table = `package a
+
+import (
+	"example.com/dep"
+	"example.com/root/b"
+)
+
+type entry ` + wasteful + `
+//memlayout:keep-order
+type ordered ` + wasteful + `
+type positional ` + wasteful + `
+var _ = positional{true, 1, false}
+
+type Table struct {
+	Entries    [4]entry
+	Ordered    [4]ordered
+	Positional [4]positional
+	Other      [4]b.Entry
+	Ignored    [4]b.Ignored
+	Dep        [4]dep.Entry
+}
+`
+	writeFiles(t, tmp, map[string]string{
+		"go.mod":     "module example.com/root\n\ngo 1.18\n\nrequire example.com/dep v0.0.0\n\nreplace example.com/dep => ./dep\n",
+		"dep/go.mod": "module example.com/dep\n",
+		"dep/dep.go": "package dep\n\ntype Entry " + wasteful,
+		"b/b.go":     "package b\n\ntype Entry " + wasteful + "\n// Ignored is not analyzed.\n//memlayout:ignore\ntype Ignored " + wasteful,
+		"a/a.go":     table,
+	})
+
+	structs, err := StructsFromFile(filepath.Join(tmp, "a", "a.go"), []byte(table))
+	require.NoError(err)
+
+	var savings []ElementSaving
+	for _, s := range structs {
+		if s.Name == "Table" {
+			savings = ElementSavings(s)
+		}
+	}
+
+	var types []string
+	for _, s := range savings {
+		types = append(types, s.Type)
+	}
+	require.Equal([]string{"entry", "b.Entry"}, types)
+}
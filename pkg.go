@@ -1,44 +1,108 @@
 package memlayout
 
 import (
+	"bytes"
 	"fmt"
 	"go/ast"
-	"go/build"
-	"go/parser"
 	"go/token"
 	"go/types"
 	"path/filepath"
-
-	"golang.org/x/tools/go/loader"
+	"strings"
 )
 
-// StructsFromFile returns the structs in the file with the given content.
+// StructsFromFile returns the structs in the file with the given content,
+// laid out for DefaultArch. Use Struct.ForArch to get their layout in other
+// architectures. The rest of the package is read from the directory of the
+// file and loaded for the host build configuration.
 func StructsFromFile(filename string, content []byte) ([]Struct, error) {
-	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, filename, content, 0)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse file %s: %s", filename, err)
-	}
+	return StructsForBuild(filename, content, Build{})
+}
+
+// notInBuildError is returned when a file is excluded from its package in
+// a build configuration.
+type notInBuildError struct {
+	filename string
+	build    Build
+}
+
+func (e *notInBuildError) Error() string {
+	return fmt.Sprintf("file %s is not part of its package in build %s", e.filename, e.build)
+}
+
+// StructsForBuild returns the structs in the file with the given content
+// when its package is loaded for the given build configuration. Structs are
+// laid out for the architecture of the build, if any, or DefaultArch.
+//
+// Besides the package-level types, types declared inside functions and
+// anonymous structs, such as the ones of variables or table-driven test
+// cases, are returned too, named after the variable, field or type they
+// are part of.
+func StructsForBuild(filename string, content []byte, build Build) ([]Struct, error) {
+	return structsForBuild(LoadPackage, filename, content, build, nil)
+}
 
-	files, err := filepath.Glob(filepath.Join(filepath.Dir(filename), "*.go"))
+// loadFunc loads the package in a directory like LoadPackage.
+type loadFunc func(dir string, overlay map[string][]byte, build Build) (*Package, error)
+
+// structsForBuild returns the structs in the file with the given content
+// like StructsForBuild, with the rest of the files of the package and its
+// dependencies read from the given overlay, if present. The package is
+// loaded with the given function.
+func structsForBuild(load loadFunc, filename string, content []byte, build Build, overlay map[string][]byte) ([]Struct, error) {
+	filename, err := filepath.Abs(filename)
 	if err != nil {
 		return nil, err
 	}
 
-	conf := loader.Config{
-		Build: &build.Default,
+	var files = make(map[string][]byte, len(overlay)+1)
+	for path, c := range overlay {
+		files[path] = c
 	}
+	files[filename] = content
 
-	if _, err = conf.FromArgs(files, true); err != nil {
-		return nil, err
+	pkg, err := load(filepath.Dir(filename), files, build)
+	if _, ok := err.(*excludedError); ok {
+		return nil, &notInBuildError{filename: filename, build: build}
 	}
 
-	lprog, err := conf.Load()
 	if err != nil {
 		return nil, err
 	}
 
-	scope := lprog.InitialPackages()[0].Pkg.Scope()
+	f := pkg.File(filename)
+	if f == nil && strings.HasSuffix(filename, "_test.go") {
+		if pkg.xtestErr != nil {
+			return nil, pkg.xtestErr
+		}
+		if pkg.XTest != nil {
+			pkg = pkg.XTest
+			f = pkg.File(filename)
+		}
+	}
+
+	if f == nil {
+		return nil, &notInBuildError{filename: filename, build: build}
+	}
+
+	return pkg.structs(f, build), nil
+}
+
+// structs returns the structs declared in the given file of the package
+// loaded for the given build configuration.
+func (pkg *Package) structs(f *ast.File, build Build) []Struct {
+	content := pkg.contents[f]
+	arch := DefaultArch
+	if build.GOARCH != "" {
+		arch = build.GOARCH
+	}
+
+	fset := pkg.Fset
+	scope := pkg.Types.Scope()
+	atomics := atomicFields(pkg.Info, pkg.Files)
+	guards := writeGuards(pkg.Info, pkg.Files)
+	unkeyed := unkeyedStructs(pkg.Info, pkg.Files)
+	shared := sharedAnonymous(pkg.Info, pkg.Files)
+	decls := make(map[*types.TypeName]*elementDecl)
 
 	var result []Struct
 	for _, name := range scope.Names() {
@@ -48,16 +112,164 @@ func StructsFromFile(filename string, content []byte) ([]Struct, error) {
 			continue
 		}
 
-		result = append(result, Struct{
-			Name:   obj.Name(),
-			Pos:    posOf(fset, f, obj.Name()),
-			Fields: Fields(s),
-		})
+		// Only the structs declared in the file are returned, not the ones
+		// of the rest of the package.
+		decl, spec := specOf(f, obj.Name())
+		if spec == nil {
+			continue
+		}
+
+		var structs []Struct
+		named := obj.Type().(*types.Named)
+		if named.TypeParams().Len() == 0 {
+			structs = append(structs, newStruct(obj.Name(), s, s, arch, build, atomics, guards))
+		} else {
+			// Generic structs have no layout of their own, so one struct is
+			// returned for every instantiation of them in the package.
+			for _, inst := range instancesOf(named, pkg.Info) {
+				str := newStruct(
+					types.TypeString(inst, types.RelativeTo(pkg.Types)),
+					inst.Underlying().(*types.Struct), s,
+					arch, build, atomics, guards,
+				)
+				str.Generic = obj.Name()
+				structs = append(structs, str)
+			}
+		}
+
+		for _, str := range structs {
+			str.Pos = posOf(fset, spec)
+			str.src = newSource(fset, content, spec)
+			str.setNodes()
+			pkg.setElementDecls(str.Fields, unkeyed, decls)
+			applyStructDirectives(&str, specDocs(decl, spec.Doc))
+			str.KeepOrder = str.KeepOrder || unkeyed[s]
+			result = append(result, str)
+		}
+	}
+
+	for _, local := range localStructs(f) {
+		s, ok := pkg.Info.TypeOf(local.st).(*types.Struct)
+		if !ok || s.NumFields() == 0 || hasTypeParam(s) {
+			continue
+		}
+
+		str := newStruct(local.name, s, s, arch, build, atomics, guards)
+		str.local = true
+		if local.spec != nil {
+			str.Pos = posOf(fset, local.spec)
+			str.src = newSource(fset, content, local.spec)
+		} else {
+			str.Pos = posOf(fset, local.st)
+			str.src = newAnonymousSource(fset, content, local.st)
+		}
+		str.setNodes()
+		pkg.setElementDecls(str.Fields, unkeyed, decls)
+		applyStructDirectives(&str, local.docs)
+		str.KeepOrder = str.KeepOrder || unkeyed[s] || shared[local.st]
+		result = append(result, str)
+	}
+
+	return result
+}
+
+// StructVariants returns the structs in the file with the given content
+// for every given build configuration the file is part of. Structs with
+// the same declaration and layout in several build configurations are
+// returned once, with all of them in Builds.
+func StructVariants(filename string, content []byte, builds []Build) ([]Struct, error) {
+	return structVariants(LoadPackage, filename, content, builds, nil)
+}
+
+// structVariants returns the structs in the file with the given content
+// like StructVariants, with the rest of the files of the package and its
+// dependencies read from the given overlay, if present. Packages are
+// loaded with the given function.
+func structVariants(load loadFunc, filename string, content []byte, builds []Build, overlay map[string][]byte) ([]Struct, error) {
+	var result []Struct
+	var keys []string
+	for _, build := range builds {
+		structs, err := structsForBuild(load, filename, content, build, overlay)
+		if _, ok := err.(*notInBuildError); ok {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+	structs:
+		for _, s := range structs {
+			key := variantKey(s)
+			for i, k := range keys {
+				if k == key {
+					result[i].Builds = append(result[i].Builds, build)
+					continue structs
+				}
+			}
+
+			result = append(result, s)
+			keys = append(keys, key)
+		}
 	}
 
 	return result, nil
 }
 
+// variantKey returns a key that is the same for the variants of a struct
+// with the same declaration and fields.
+func variantKey(s Struct) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s:%d:%d", s.Name, s.Start, s.End)
+	for _, f := range s.ForArch(DefaultArch).Fields {
+		fmt.Fprintf(&buf, ";%s %s %d-%d", f.Name, f.Type, f.Start, f.End)
+	}
+	return buf.String()
+}
+
+// newStruct returns the struct with the given type laid out for the given
+// architecture. Origin is the declared type of the struct, which is
+// different from typ for instantiations of generic structs, and is used to
+// look up the atomic operations and locks used on its fields.
+func newStruct(
+	name string,
+	typ, origin *types.Struct,
+	arch string,
+	build Build,
+	atomics map[*types.Var]bool,
+	guards map[*types.Var][]string,
+) Struct {
+	fields := Fields(typ, arch)
+	for i := range fields {
+		if fields[i].IsPadding {
+			continue
+		}
+
+		v := originField(fields[i].field, typ, origin)
+		if atomics[v] {
+			fields[i].Atomic64 = true
+		}
+		fields[i].Guards = guards[v]
+	}
+
+	return Struct{
+		Name:   name,
+		Arch:   arch,
+		Fields: fields,
+		Builds: []Build{build},
+	}
+}
+
+// setNodes links the fields of the struct, and of its nested anonymous
+// structs, to the nodes they were declared in and sets their positions.
+func (s *Struct) setNodes() {
+	if s.src == nil {
+		return
+	}
+
+	s.src.setNodes(s.Fields, s.src.fieldNodes())
+}
+
 func structFromObject(obj types.Object) (*types.Struct, bool) {
 	named, ok := obj.Type().(*types.Named)
 	if !ok {
@@ -68,7 +280,7 @@ func structFromObject(obj types.Object) (*types.Struct, bool) {
 	return s, ok
 }
 
-func posOf(fset *token.FileSet, f *ast.File, name string) Pos {
+func specOf(f *ast.File, name string) (*ast.GenDecl, *ast.TypeSpec) {
 	for _, d := range f.Decls {
 		gd, ok := d.(*ast.GenDecl)
 		if !ok {
@@ -77,18 +289,20 @@ func posOf(fset *token.FileSet, f *ast.File, name string) Pos {
 
 		for _, spec := range gd.Specs {
 			ts, ok := spec.(*ast.TypeSpec)
-			if !ok || ts.Name.Name != name {
-				continue
-			}
-
-			fi := fset.File(ts.Pos())
-
-			return Pos{
-				Start: fi.Line(ts.Pos()),
-				End:   fi.Line(ts.End()),
+			if ok && ts.Name.Name == name {
+				return gd, ts
 			}
 		}
 	}
 
-	return Pos{}
+	return nil, nil
+}
+
+func posOf(fset *token.FileSet, n ast.Node) Pos {
+	fi := fset.File(n.Pos())
+
+	return Pos{
+		Start: fi.Line(n.Pos()),
+		End:   fi.Line(n.End()),
+	}
 }
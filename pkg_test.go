@@ -50,19 +50,19 @@ func TestStructsFromFile(t *testing.T) {
 	require.NoError(err)
 
 	expected := []Struct{
-		{"Bar", Pos{6, 9}, []Field{
+		{Name: "Bar", Pos: Pos{6, 9}, Fields: []Field{
 			f("A", "int", 0, 8, 8, 8, false),
-			f("B", "string", 8, 24, 16, 8, false),
+			withPtrData(f("B", "string", 8, 24, 16, 8, false), 8),
 		}},
-		{"Qux", Pos{15, 23}, []Field{
+		{Name: "Qux", Pos: Pos{15, 23}, Fields: []Field{
 			f("A", "int", 0, 8, 8, 8, false),
 			f("B", "bool", 8, 9, 1, 1, false),
 			f("", "", 9, 16, 7, 0, true),
-			f("C", "struct{D int64; E []byte}", 16, 48, 32, 8, false,
+			withPtrData(f("C", "struct{D int64; E []byte}", 16, 48, 32, 8, false,
 				f("D", "int64", 16, 24, 8, 8, false),
-				f("E", "[]byte", 24, 48, 24, 8, false),
-			),
-			f("F", "*string", 48, 56, 8, 8, false),
+				withPtrData(f("E", "[]byte", 24, 48, 24, 8, false), 8),
+			), 16),
+			withPtrData(f("F", "*string", 48, 56, 8, 8, false), 8),
 		}},
 	}
 
@@ -89,3 +89,8 @@ func f(
 		Children:  children,
 	}
 }
+
+func withPtrData(f Field, ptrData int64) Field {
+	f.PtrData = ptrData
+	return f
+}
@@ -0,0 +1,99 @@
+package memlayout
+
+import "go/types"
+
+// ptrdata returns the size of the prefix of a value of the given type that
+// can contain pointers, which is the part of it the garbage collector has
+// to scan.
+func ptrdata(typ types.Type, sizes types.Sizes) int64 {
+	word := sizes.Sizeof(types.Typ[types.UnsafePointer])
+
+	switch t := typ.Underlying().(type) {
+	case *types.Basic:
+		switch t.Kind() {
+		case types.String, types.UnsafePointer:
+			return word
+		}
+		return 0
+	case *types.Pointer, *types.Map, *types.Chan, *types.Signature, *types.Slice:
+		return word
+	case *types.Interface:
+		return 2 * word
+	case *types.Array:
+		elem := ptrdata(t.Elem(), sizes)
+		if t.Len() == 0 || elem == 0 {
+			return 0
+		}
+		return (t.Len()-1)*sizes.Sizeof(t.Elem()) + elem
+	case *types.Struct:
+		var fields []*types.Var
+		for i := 0; i < t.NumFields(); i++ {
+			fields = append(fields, t.Field(i))
+		}
+		return structPtrData(fields, sizes)
+	}
+
+	return 0
+}
+
+func structPtrData(fields []*types.Var, sizes types.Sizes) int64 {
+	offsets := sizes.Offsetsof(fields)
+
+	var result int64
+	for i, f := range fields {
+		if pd := ptrdata(f.Type(), sizes); pd > 0 {
+			result = offsets[i] + pd
+		}
+	}
+	return result
+}
+
+// PtrData returns the size of the prefix of the struct that can contain
+// pointers, which is the part of it the garbage collector has to scan.
+func (s Struct) PtrData() int64 {
+	var result int64
+	for _, f := range s.Fields {
+		if f.PtrData > 0 {
+			result = f.Start + f.PtrData
+		}
+	}
+	return result
+}
+
+// totalPtrData returns the sum of the pointer prefixes of a struct with the
+// given fields in all the given architectures.
+func totalPtrData(vars []*types.Var, archs []string) int64 {
+	var total int64
+	for _, arch := range archs {
+		total += structPtrData(vars, sizesFor(arch))
+	}
+	return total
+}
+
+// byPointers sorts fields like byAlignSizeAndName, but fields that can be
+// laid out in any order without changing the size of the struct are sorted
+// so the ones with pointers come first, and among them, the ones with a
+// longer tail without pointers come last. This reduces the prefix of the
+// struct the garbage collector has to scan.
+type byPointers struct{ byAlignSizeAndName }
+
+func (s byPointers) Less(i, j int) bool {
+	a, b := s.byAlignSizeAndName[i], s.byAlignSizeAndName[j]
+	interchangeable := a.Pin == NotPinned && b.Pin == NotPinned &&
+		(a.Size == 0) == (b.Size == 0) &&
+		a.Atomic64 == b.Atomic64 &&
+		a.Hot == b.Hot &&
+		a.Align == b.Align
+
+	if interchangeable {
+		if (a.PtrData > 0) != (b.PtrData > 0) {
+			return a.PtrData > 0
+		}
+
+		if a.PtrData > 0 && a.Size-a.PtrData != b.Size-b.PtrData {
+			return a.Size-a.PtrData < b.Size-b.PtrData
+		}
+	}
+
+	return s.byAlignSizeAndName.Less(i, j)
+}
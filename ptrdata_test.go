@@ -0,0 +1,83 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const pointersSource = `
+package foo
+
+type Foo struct {
+	A int64
+	B string
+	C int64
+	D *int
+	E []byte
+	F bool
+}
+`
+
+func TestOptimizePtrData(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(pointersSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(pointersSource))
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal(int64(48), structs[0].PtrData())
+
+	optimized := Optimize(structs[0])
+	require.Equal(structs[0].Size(), optimized.Size())
+	require.Equal(int64(64), optimized.PtrData())
+
+	optimized = OptimizeWith(structs[0], Options{PtrData: true})
+	require.Equal(structs[0].Size(), optimized.Size())
+	require.Equal(int64(32), optimized.PtrData())
+
+	var names []string
+	for _, f := range optimized.Fields {
+		if !f.IsPadding {
+			names = append(names, f.Name)
+		}
+	}
+	require.Equal([]string{"D", "B", "E", "A", "C", "F"}, names)
+}
+
+func TestImprovesPtrDataThresholds(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(pointersSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(pointersSource))
+	require.NoError(err)
+	require.Len(structs, 1)
+
+	// The layout only reduces the pointer-scan prefix, so it does not save
+	// the bytes the thresholds ask for.
+	before := structs[0]
+	after := OptimizeWith(before, Options{PtrData: true})
+	require.True(Config{PtrData: true}.improves(before, after))
+	require.False(Config{PtrData: true, MinBytes: 8}.improves(before, after))
+	require.False(Config{PtrData: true, MinPercent: 5}.improves(before, after))
+	require.False(Config{PtrData: true, SizeClassOnly: true}.improves(before, after))
+}
@@ -0,0 +1,253 @@
+package memlayout
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Session loads packages and keeps them, so finding the structs of several
+// files of the same package only type-checks it once. Packages are kept by
+// directory and by the content of their files and of the files of the
+// packages they import from the modules being analyzed, in the given
+// overlay or on disk, so they are reused whatever the rest of the overlay
+// is. Packages of the standard library and of the module cache are
+// expected not to change during the session. It is safe for concurrent use.
+type Session struct {
+	// max is the maximum number of packages kept, or zero for no limit.
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*sessionEntry
+	// deps are the dependencies of the last package loaded for every key
+	// of the files of a directory, which are the ones the key of the
+	// dependencies of the next packages with the same files covers.
+	deps map[string]*packageDeps
+	// uses is incremented every time a package is used, to know the least
+	// recently used one.
+	uses uint64
+}
+
+// sessionEntry is a package of a Session.
+type sessionEntry struct {
+	once sync.Once
+	pkg  *Package
+	err  error
+	// files is the key of the directory and files of the package.
+	files   string
+	lastUse uint64
+}
+
+// NewSession returns a new session that keeps the given maximum number of
+// packages, evicting the least recently used ones, or any number of them
+// if it is zero.
+func NewSession(max int) *Session {
+	return &Session{
+		max:     max,
+		entries: make(map[string]*sessionEntry),
+		deps:    make(map[string]*packageDeps),
+	}
+}
+
+// Package returns the package in the given directory loaded with
+// LoadPackage with the given overlay and build configuration, loading it
+// only if it is not kept by the session already.
+func (s *Session) Package(dir string, overlay map[string][]byte, build Build) (*Package, error) {
+	files, err := packageKey(dir, overlay, build)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	deps := s.deps[files]
+	s.mu.Unlock()
+	key := files + depsKey(deps, overlay)
+
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if !ok {
+		e = &sessionEntry{files: files}
+		s.entries[key] = e
+	}
+	s.uses++
+	e.lastUse = s.uses
+	s.evict()
+	s.mu.Unlock()
+
+	e.once.Do(func() {
+		e.pkg, e.err = LoadPackage(dir, overlay, build)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// The package is loaded again the next time, as the failure may
+		// be transient.
+		if e.err != nil {
+			if s.entries[key] == e {
+				s.remove(key)
+			}
+			return
+		}
+		s.deps[files] = &e.pkg.deps
+
+		// Without the dependencies of another package with the same files,
+		// the key covered the whole overlay.
+		if loaded := files + depsKey(&e.pkg.deps, overlay); loaded != key && s.entries[key] == e {
+			delete(s.entries, key)
+			s.entries[loaded] = e
+		}
+	})
+	return e.pkg, e.err
+}
+
+// forget removes the packages in the given directory or its
+// subdirectories, which are not needed anymore because it was removed.
+func (s *Session) forget(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, e := range s.entries {
+		if e.pkg != nil && (e.pkg.Dir == dir || strings.HasPrefix(e.pkg.Dir, dir+string(filepath.Separator))) {
+			s.remove(key)
+		}
+	}
+}
+
+// evict removes the least recently used packages while there are more
+// than the maximum. It must be called with the lock of the session held.
+func (s *Session) evict() {
+	for s.max > 0 && len(s.entries) > s.max {
+		var oldest string
+		for key, e := range s.entries {
+			if oldest == "" || e.lastUse < s.entries[oldest].lastUse {
+				oldest = key
+			}
+		}
+		s.remove(oldest)
+	}
+}
+
+// remove removes the package with the given key, and the dependencies
+// kept for its files if no other package has them. It must be called with
+// the lock of the session held.
+func (s *Session) remove(key string) {
+	files := s.entries[key].files
+	delete(s.entries, key)
+
+	for _, e := range s.entries {
+		if e.files == files {
+			return
+		}
+	}
+	delete(s.deps, files)
+}
+
+// Structs returns the structs in the file with the given content like
+// StructsForBuild, with the rest of the files of the package and its
+// dependencies read from the given overlay, if present.
+func (s *Session) Structs(filename string, content []byte, build Build, overlay map[string][]byte) ([]Struct, error) {
+	return structsForBuild(s.Package, filename, content, build, overlay)
+}
+
+// StructVariants returns the structs in the file with the given content
+// like StructVariants, with the rest of the files of the package and its
+// dependencies read from the given overlay, if present.
+func (s *Session) StructVariants(filename string, content []byte, builds []Build, overlay map[string][]byte) ([]Struct, error) {
+	return structVariants(s.Package, filename, content, builds, overlay)
+}
+
+// Audit returns the structs wasting memory in the packages of the given
+// directory like Audit, loading them with the session.
+func (s *Session) Audit(dir string, build Build, arch string) ([]Waste, []error, error) {
+	return audit(s.Package, dir, build, arch)
+}
+
+// packageKey returns a key that is different for every directory, build
+// configuration and content of the Go files in the directory, in the
+// overlay or on disk.
+func packageKey(dir string, overlay map[string][]byte, build Build) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", dir, build)
+	if err := hashDir(h, dir, overlay); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// depsKey returns a key that is different for every content of the given
+// dependencies of a package, in the overlay or on disk. If they are not
+// known, it is different for every content of the overlay.
+func depsKey(deps *packageDeps, overlay map[string][]byte) string {
+	h := sha256.New()
+	if deps == nil {
+		var paths []string
+		for path := range overlay {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			fmt.Fprintf(h, "%s\x00%x\x00", path, sha256.Sum256(overlay[path]))
+		}
+		return fmt.Sprintf("%x", h.Sum(nil))
+	}
+
+	for _, path := range deps.modFiles {
+		content, ok := overlay[path]
+		if !ok {
+			content, _ = ioutil.ReadFile(path)
+		}
+		fmt.Fprintf(h, "%s\x00%x\x00", path, sha256.Sum256(content))
+	}
+
+	for _, dir := range deps.dirs {
+		if err := hashDir(h, dir, overlay); err != nil {
+			fmt.Fprintf(h, "%s\x00", err)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// hashDir writes the paths and hashes of the Go files in the given
+// directory, in the overlay or on disk, to the given hash.
+func hashDir(h io.Writer, dir string, overlay map[string][]byte) error {
+	var paths []string
+	for path := range overlay {
+		if filepath.Dir(path) == dir && strings.HasSuffix(path, ".go") {
+			paths = append(paths, path)
+		}
+	}
+
+	// The directory may only exist in the overlay.
+	infos, _ := ioutil.ReadDir(dir)
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if _, ok := overlay[path]; !ok && !info.IsDir() && strings.HasSuffix(info.Name(), ".go") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		content, ok := overlay[path]
+		if !ok {
+			var err error
+			content, err = ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(h, "%s\x00%x\x00", path, sha256.Sum256(content))
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a/a.go": "package a\n\ntype A struct {\n\tX bool\n\tY int64\n}\n",
+		"a/b.go": "package a\n\ntype B struct {\n\tA A\n\tZ bool\n}\n",
+	})
+
+	a := filepath.Join(tmp, "a", "a.go")
+	b := filepath.Join(tmp, "a", "b.go")
+	contentA, err := ioutil.ReadFile(a)
+	require.NoError(err)
+	contentB, err := ioutil.ReadFile(b)
+	require.NoError(err)
+
+	session := NewSession(0)
+	structs, err := session.Structs(a, contentA, Build{}, nil)
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal(int64(16), structs[0].Size())
+
+	// The files of the package did not change, so it is not loaded again.
+	structs, err = session.Structs(b, contentB, Build{}, nil)
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal(int64(24), structs[0].Size())
+	require.Len(session.entries, 1)
+
+	pkg1, err := session.Package(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	pkg2, err := session.Package(filepath.Join(tmp, "a"), map[string][]byte{a: contentA}, Build{})
+	require.NoError(err)
+	require.True(pkg1 == pkg2)
+
+	// A different content of any file of the package loads it again.
+	structs, err = session.Structs(b, contentB, Build{}, map[string][]byte{
+		a: []byte("package a\n\ntype A struct {\n\tX bool\n\tY int32\n}\n"),
+	})
+	require.NoError(err)
+	require.Equal(int64(12), structs[0].Size())
+	require.Len(session.entries, 2)
+
+	writeFiles(t, tmp, map[string]string{
+		"a/a.go": "package a\n\ntype A struct {\n\tX bool\n}\n",
+	})
+	pkg3, err := session.Package(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	require.False(pkg1 == pkg3)
+	require.Equal(int64(1), sizesFor(DefaultArch).Sizeof(pkg3.Types.Scope().Lookup("A").Type()))
+
+	// Other build configurations are loaded separately, but the host one is
+	// the same as the default one.
+	host := Build{GOOS: Build{}.goos(), GOARCH: Build{}.goarch()}
+	structs, err = session.StructVariants(b, contentB, []Build{host, {GOOS: "linux", GOARCH: "arm"}}, nil)
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Len(structs[0].Builds, 2)
+	require.Len(session.entries, 4)
+}
+
+func TestSessionEviction(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a/a.go": "package a\n\ntype A struct{}\n",
+		"b/b.go": "package b\n\ntype B struct{}\n",
+		"c/c.go": "package c\n\ntype C struct{}\n",
+	})
+
+	session := NewSession(2)
+	pkgA, err := session.Package(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	_, err = session.Package(filepath.Join(tmp, "b"), nil, Build{})
+	require.NoError(err)
+
+	// a is used again, so b is the least recently used one.
+	pkg, err := session.Package(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	require.True(pkgA == pkg)
+
+	_, err = session.Package(filepath.Join(tmp, "c"), nil, Build{})
+	require.NoError(err)
+	require.Len(session.entries, 2)
+
+	keyA, err := packageKey(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	keyB, err := packageKey(filepath.Join(tmp, "b"), nil, Build{})
+	require.NoError(err)
+	var kept []string
+	for _, e := range session.entries {
+		kept = append(kept, e.files)
+	}
+	require.Contains(kept, keyA)
+	require.NotContains(kept, keyB)
+	require.Contains(session.deps, keyA)
+	require.NotContains(session.deps, keyB)
+}
+
+func TestSessionConcurrent(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a/a.go": "package a\n\ntype A struct {\n\tX bool\n\tY int64\n}\n",
+	})
+
+	session := NewSession(0)
+	pkgs := make([]*Package, 8)
+	errs := make([]error, len(pkgs))
+	var wg sync.WaitGroup
+	for i := range pkgs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			pkgs[i], errs[i] = session.Package(filepath.Join(tmp, "a"), nil, Build{})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range pkgs {
+		require.NoError(errs[i])
+		require.True(pkgs[0] == pkgs[i])
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a/a.go": "package a\n\nimport \"example.com/root/b\"\n\ntype A struct {\n\tX bool\n\tB b.B\n}\n",
+	})
+
+	session := NewSession(0)
+	_, err = session.Package(filepath.Join(tmp, "a"), nil, Build{})
+	require.Error(err)
+	require.Len(session.entries, 0)
+
+	// Packages that failed to load are loaded again, as the failure may
+	// have been transient.
+	writeFiles(t, tmp, map[string]string{
+		"b/b.go": "package b\n\ntype B struct {\n\tI int64\n}\n",
+	})
+	pkg, err := session.Package(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	require.Equal("example.com/root/a", pkg.Path)
+	require.Len(session.entries, 1)
+}
+
+func TestSessionAudit(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	writeFiles(t, tmp, map[string]string{
+		"go.mod": "module example.com/root\n",
+		"a/a.go": "package a\n\ntype Small struct {\n\tA bool\n\tB int32\n\tC bool\n}\n",
+		"b/b.go": "package b\n\ntype Big struct {\n\tA bool\n\tB int64\n\tC bool\n}\n",
+	})
+
+	session := NewSession(0)
+	waste, errs, err := session.Audit(tmp, Build{}, "amd64")
+	require.NoError(err)
+	require.Len(errs, 0)
+	require.Equal([]string{"example.com/root/b", "example.com/root/a"}, wastePackages(waste))
+
+	// The audited packages are kept by the session.
+	require.Len(session.entries, 2)
+	pkg, err := session.Package(filepath.Join(tmp, "a"), nil, Build{})
+	require.NoError(err)
+	for _, e := range session.entries {
+		if e.pkg.Dir == pkg.Dir {
+			require.True(e.pkg == pkg)
+		}
+	}
+	require.Len(session.entries, 2)
+}
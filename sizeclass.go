@@ -0,0 +1,37 @@
+package memlayout
+
+import "sort"
+
+// sizeClasses are the sizes of the objects the Go runtime allocator uses
+// for small allocations. Anything allocated is rounded up to the smallest
+// size class it fits in.
+var sizeClasses = []int64{
+	0, 8, 16, 24, 32, 48, 64, 80, 96, 112, 128, 144, 160, 176, 192, 208,
+	224, 240, 256, 288, 320, 352, 384, 416, 448, 480, 512, 576, 640, 704,
+	768, 896, 1024, 1152, 1280, 1408, 1536, 1792, 2048, 2304, 2688, 3072,
+	3200, 3456, 4096, 4864, 5376, 6144, 6528, 6784, 6912, 8192, 9472, 9728,
+	10240, 10880, 12288, 13568, 14336, 16384, 18432, 19072, 20480, 21760,
+	24576, 27264, 28672, 32768,
+}
+
+// pageSize is the size of the pages large objects are allocated in.
+const pageSize = 8192
+
+// SizeClass returns the number of bytes the Go runtime actually allocates
+// for an object of the given size.
+func SizeClass(size int64) int64 {
+	if size > sizeClasses[len(sizeClasses)-1] {
+		return (size + pageSize - 1) / pageSize * pageSize
+	}
+
+	i := sort.Search(len(sizeClasses), func(i int) bool {
+		return sizeClasses[i] >= size
+	})
+	return sizeClasses[i]
+}
+
+// SizeClass returns the number of bytes the Go runtime actually allocates
+// for the struct in its architecture.
+func (s Struct) SizeClass() int64 {
+	return SizeClass(s.Size())
+}
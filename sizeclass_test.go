@@ -0,0 +1,27 @@
+package memlayout
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeClass(t *testing.T) {
+	cases := []struct {
+		size     int64
+		expected int64
+	}{
+		{0, 0},
+		{1, 8},
+		{8, 8},
+		{49, 64},
+		{52, 64},
+		{64, 64},
+		{32768, 32768},
+		{32769, 40960},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.expected, SizeClass(c.size), "size %d", c.size)
+	}
+}
@@ -0,0 +1,230 @@
+package memlayout
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/token"
+	"strings"
+)
+
+// source is the declaration of a struct in its original source code. It is
+// used to print the struct in a different field order without losing
+// anything the type checker does not know about, such as tags, comments,
+// embedded fields or the import names used in the file.
+type source struct {
+	content []byte
+	fset    *token.FileSet
+	// spec is nil for anonymous structs.
+	spec *ast.TypeSpec
+	st   *ast.StructType
+}
+
+// fieldNode is the node a struct field was declared in. Ident is nil for
+// embedded fields.
+type fieldNode struct {
+	field *ast.Field
+	ident *ast.Ident
+}
+
+// pos returns the position of the name of the field, or of its type if it
+// is embedded.
+func (n fieldNode) pos() token.Pos {
+	if n.ident != nil {
+		return n.ident.Pos()
+	}
+	return n.field.Type.Pos()
+}
+
+// newSource returns the source of the given struct declaration, or nil if
+// the declaration is not a struct.
+func newSource(fset *token.FileSet, content []byte, spec *ast.TypeSpec) *source {
+	st, ok := spec.Type.(*ast.StructType)
+	if !ok {
+		return nil
+	}
+	return &source{content: content, fset: fset, spec: spec, st: st}
+}
+
+// newAnonymousSource returns the source of the given anonymous struct.
+func newAnonymousSource(fset *token.FileSet, content []byte, st *ast.StructType) *source {
+	return &source{content: content, fset: fset, st: st}
+}
+
+// fieldNodes returns the node of every field in the struct, in the same
+// order the type checker reports them.
+func (src *source) fieldNodes() []fieldNode {
+	return structFieldNodes(src.st)
+}
+
+// structFieldNodes returns the node of every field in the given struct
+// type, in the same order the type checker reports them.
+func structFieldNodes(st *ast.StructType) []fieldNode {
+	var result []fieldNode
+	for _, f := range st.Fields.List {
+		if len(f.Names) == 0 {
+			result = append(result, fieldNode{field: f})
+			continue
+		}
+
+		for _, name := range f.Names {
+			result = append(result, fieldNode{field: f, ident: name})
+		}
+	}
+	return result
+}
+
+// setNodes links the given fields to the nodes they were declared in, and
+// the fields of nested anonymous structs to theirs, and sets their
+// positions.
+func (src *source) setNodes(fields []Field, nodes []fieldNode) {
+	var i int
+	for j := range fields {
+		if fields[j].IsPadding || i >= len(nodes) {
+			continue
+		}
+
+		fields[j].node = &nodes[i]
+		fields[j].Position = src.fset.Position(nodes[i].pos())
+		if st, ok := nodes[i].field.Type.(*ast.StructType); ok {
+			src.setNodes(fields[j].Children, structFieldNodes(st))
+		}
+		i++
+	}
+}
+
+func (src *source) text(from, to token.Pos) string {
+	file := src.fset.File(from)
+	return string(src.content[file.Offset(from):file.Offset(to)])
+}
+
+// anonymousHeader is used to format anonymous structs as a declaration.
+const anonymousHeader = "type _ "
+
+// render returns the declaration of the struct with its fields in the
+// given order, or the struct type if it is anonymous. Fields declared
+// together are kept together if their order did not change and split
+// otherwise.
+func (src *source) render(layout []Field) (string, error) {
+	st := src.st
+
+	var buf bytes.Buffer
+	if src.spec != nil {
+		buf.WriteString("type ")
+		buf.WriteString(src.text(src.spec.Pos(), st.Fields.Opening+1))
+	} else {
+		buf.WriteString(anonymousHeader)
+		buf.WriteString(src.text(st.Pos(), st.Fields.Opening+1))
+	}
+	buf.WriteRune('\n')
+	buf.WriteString(src.fieldsText(layout))
+	buf.WriteString("}")
+
+	out, err := format.Source(buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	if src.spec == nil {
+		return strings.TrimPrefix(string(out), anonymousHeader), nil
+	}
+
+	return string(out), nil
+}
+
+// fieldsText returns the source code of the given fields, one per line.
+func (src *source) fieldsText(layout []Field) string {
+	var fields []Field
+	for _, f := range layout {
+		if !f.IsPadding && f.node != nil {
+			fields = append(fields, f)
+		}
+	}
+
+	var buf bytes.Buffer
+	var written = make(map[*ast.Field]bool)
+	for i := 0; i < len(fields); i++ {
+		node := fields[i].node
+		typ := src.typeText(fields[i])
+		if n := len(node.field.Names); n > 1 && sameNode(fields[i:], node) {
+			buf.WriteString(src.fieldText(node.field, typ, node.field.Names, true))
+			i += n - 1
+		} else {
+			var idents []*ast.Ident
+			if node.ident != nil {
+				idents = []*ast.Ident{node.ident}
+			}
+			buf.WriteString(src.fieldText(node.field, typ, idents, !written[node.field]))
+		}
+
+		written[node.field] = true
+		buf.WriteRune('\n')
+	}
+
+	return buf.String()
+}
+
+// typeText returns the source code of the type of the field. Nested
+// anonymous structs are written with their fields in the order of the
+// layout.
+func (src *source) typeText(f Field) string {
+	t := f.node.field.Type
+	st, ok := t.(*ast.StructType)
+	if !ok || len(f.Children) == 0 {
+		return src.text(t.Pos(), t.End())
+	}
+
+	for _, c := range f.Children {
+		if !c.IsPadding && c.node == nil {
+			return src.text(t.Pos(), t.End())
+		}
+	}
+
+	return src.text(st.Pos(), st.Fields.Opening+1) + "\n" + src.fieldsText(f.Children) + "}"
+}
+
+// sameNode reports whether the first fields are all the names declared in
+// the given node, in their original order.
+func sameNode(fields []Field, node *fieldNode) bool {
+	if len(fields) < len(node.field.Names) {
+		return false
+	}
+
+	for i, name := range node.field.Names {
+		if fields[i].node == nil || fields[i].node.ident != name {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldText returns the source code of the field with the given type and
+// only the given names. The doc comment of the field is only included if
+// doc is true.
+func (src *source) fieldText(f *ast.Field, typ string, idents []*ast.Ident, doc bool) string {
+	var parts []string
+	if doc && f.Doc != nil {
+		parts = append(parts, src.text(f.Doc.Pos(), f.Doc.End())+"\n")
+	}
+
+	var names []string
+	for _, ident := range idents {
+		names = append(names, ident.Name)
+	}
+
+	line := []string{typ}
+	if len(names) > 0 {
+		line = append([]string{strings.Join(names, ", ")}, line...)
+	}
+
+	if f.Tag != nil {
+		line = append(line, f.Tag.Value)
+	}
+
+	if f.Comment != nil {
+		line = append(line, src.text(f.Comment.Pos(), f.Comment.End()))
+	}
+
+	parts = append(parts, strings.Join(line, " "))
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,59 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const commentedSource = `
+package foo
+
+import str "strings"
+
+type Base struct {
+	ID int64
+}
+
+// Foo is documented.
+type Foo struct {
+	// Valid is documented.
+	Valid bool ` + "`json:\"valid\"`" + `
+	Builder *str.Builder // Builder has a line comment.
+	X, Y    bool
+	Base
+	Count int32
+}
+`
+
+func TestStructString(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(commentedSource), 0755))
+
+	structs, err := StructsFromFile(path, []byte(commentedSource))
+	require.NoError(err)
+	require.Len(structs, 2)
+	require.Equal("Foo", structs[1].Name)
+
+	expected := "type Foo struct {\n" +
+		"\tBase\n" +
+		"\tBuilder *str.Builder // Builder has a line comment.\n" +
+		"\tCount   int32\n" +
+		"\t// Valid is documented.\n" +
+		"\tValid bool `json:\"valid\"`\n" +
+		"\tX, Y  bool\n" +
+		"}"
+
+	require.Equal(expected, Optimize(structs[1]).String())
+}
@@ -4,14 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"go/ast"
-	"go/build"
 	"go/printer"
 	"go/token"
 	"go/types"
 	"sort"
 	"strings"
-
-	"honnef.co/go/tools/gcsizes"
 )
 
 // Pos has the start and end line of a struct.
@@ -20,11 +17,29 @@ type Pos struct {
 	End   int
 }
 
-// Struct represents a struct with its fields.
+// Struct represents a struct with its fields laid out in memory for a
+// specific architecture.
 type Struct struct {
 	Name string
 	Pos
+	// Arch is the architecture the fields were laid out for.
+	Arch   string
 	Fields []Field
+	// Ignore reports whether the struct must be excluded from the analysis.
+	Ignore bool
+	// KeepOrder reports whether the fields of the struct must never be
+	// reordered, because of a directive, a host layout marker field or
+	// composite literals without field keys in its package.
+	KeepOrder bool
+	// Builds are the build configurations the struct was found in.
+	Builds []Build
+	// Generic is the name of the generic struct this struct is an
+	// instantiation of, if any. Name includes the type arguments then.
+	Generic string
+	src     *source
+	// local is true for structs that cannot be referred to by their name
+	// from the package scope, such as anonymous structs.
+	local bool
 }
 
 // Field represents a struct field.
@@ -36,8 +51,29 @@ type Field struct {
 	Size      int64
 	Align     int64
 	IsPadding bool
-	Children  []Field
-	field     *types.Var
+	// Atomic64 reports whether the field holds a 64-bit value accessed with
+	// atomic operations, so it must be 64-bit aligned.
+	Atomic64 bool
+	// Pin is the position the field must keep when the struct is optimized.
+	Pin Pin
+	// Hot reports whether the field is frequently accessed, so it must be
+	// kept in the first cache lines of the struct.
+	Hot bool
+	// Guards are the names of the locks held when the field is written. A
+	// field written with atomic operations, or a lock, is its own guard.
+	Guards []string
+	// PtrData is the size of the prefix of the field that can contain
+	// pointers. It is zero if the field has no pointers.
+	PtrData int64
+	// Position is where the field is declared in the source code. It is
+	// not valid for padding and for fields with unknown source.
+	Position token.Position
+	Children []Field
+	field    *types.Var
+	node     *fieldNode
+	// elem is the declaration of the named struct type the field holds,
+	// directly or as the element of an array, if it can be changed.
+	elem *elementDecl
 }
 
 func (f Field) String() string {
@@ -71,7 +107,16 @@ func structType(fields []Field) *ast.StructType {
 	return &ast.StructType{Fields: &ast.FieldList{List: fs}}
 }
 
+// String returns the declaration of the struct with its fields in their
+// current order. If the struct was read from source code, its original
+// field declarations are used, so the result can be pasted as-is.
 func (s Struct) String() string {
+	if s.src != nil {
+		if out, err := s.src.render(s.Fields); err == nil {
+			return out
+		}
+	}
+
 	fset := token.NewFileSet()
 	var buf bytes.Buffer
 	_ = printer.Fprint(&buf, fset, &ast.GenDecl{
@@ -84,10 +129,21 @@ func (s Struct) String() string {
 	return buf.String()
 }
 
-// Size returns the total size of the struct.
+// Size returns the total size of the struct, as computed by the sizes of
+// its architecture. Structs with fields of unknown types, which are not
+// returned by this package, get the sum of the size of their fields.
 func (s Struct) Size() int64 {
-	var total int64
+	vars := s.vars()
+	known := len(vars) > 0
+	for _, v := range vars {
+		known = known && v != nil
+	}
+
+	if known {
+		return sizesFor(s.Arch).Sizeof(types.NewStruct(vars, nil))
+	}
 
+	var total int64
 	for _, f := range s.Fields {
 		total += f.Size
 	}
@@ -108,14 +164,115 @@ func (s Struct) Padding() int64 {
 	return total
 }
 
-// Fields returns the fields of a struct with their memory layout info,
-func Fields(typ *types.Struct) []Field {
-	return sizes(typ, 0)
+// Hole is padding added after a field so that the next field, or the end
+// of the struct, is correctly aligned.
+type Hole struct {
+	// After is the field the padding follows.
+	After Field
+	// Next is the field that has to be aligned, or nil if the padding is at
+	// the end of the struct.
+	Next *Field
+	Size int64
+}
+
+// Holes returns the padding in the struct along with the fields causing it.
+func (s Struct) Holes() []Hole {
+	var result []Hole
+	for i, f := range s.Fields {
+		if !f.IsPadding || i == 0 {
+			continue
+		}
+
+		h := Hole{After: s.Fields[i-1], Size: f.Size}
+		if i+1 < len(s.Fields) {
+			h.Next = &s.Fields[i+1]
+		}
+		result = append(result, h)
+	}
+	return result
+}
+
+// Align returns the alignment of the struct, which is the largest
+// alignment of its fields.
+func (s Struct) Align() int64 {
+	var align int64 = 1
+	for _, f := range s.Fields {
+		if f.Align > align {
+			align = f.Align
+		}
+	}
+	return align
+}
+
+// ForArch returns the same struct laid out for the given architecture.
+func (s Struct) ForArch(arch string) Struct {
+	s.Fields = s.layout(s.vars(), arch)
+	s.Arch = arch
+	return s
+}
+
+// layout returns the fields of the struct in the given order laid out for
+// the given architecture, keeping the information that does not come from
+// the field types.
+func (s Struct) layout(vars []*types.Var, arch string) []Field {
+	fields := Fields(types.NewStruct(vars, nil), arch)
+	copyFieldData(fields, s.Fields)
+	return fields
+}
+
+// copyFieldData copies what is known about the fields, and their nested
+// fields, from a previous layout of them.
+func copyFieldData(fields, from []Field) {
+	for i := range fields {
+		if fields[i].IsPadding {
+			continue
+		}
+
+		for _, f := range from {
+			if !f.IsPadding && sameVar(f.field, fields[i].field) {
+				fields[i].Atomic64 = f.Atomic64
+				fields[i].Pin = f.Pin
+				fields[i].Hot = f.Hot
+				fields[i].Guards = f.Guards
+				fields[i].Position = f.Position
+				fields[i].node = f.node
+				fields[i].elem = f.elem
+				copyFieldData(fields[i].Children, f.Children)
+				break
+			}
+		}
+	}
+}
+
+// sameVar reports whether both variables are the same field, even if one
+// of them was recreated with a different type, as optimized nested structs
+// are.
+func sameVar(a, b *types.Var) bool {
+	if a == b {
+		return true
+	}
+
+	return a != nil && b != nil && a.Pos().IsValid() &&
+		a.Pos() == b.Pos() && a.Name() == b.Name()
 }
 
-var gcSizes = gcsizes.ForArch(build.Default.GOARCH)
+func (s Struct) vars() []*types.Var {
+	var vars []*types.Var
+	for _, f := range s.Fields {
+		if !f.IsPadding {
+			vars = append(vars, f.field)
+		}
+	}
+	return vars
+}
 
-func sizes(typ *types.Struct, base int64) (out []Field) {
+// Fields returns the fields of a struct with their memory layout info for
+// the given architecture.
+func Fields(typ *types.Struct, arch string) []Field {
+	return sizes(typ, 0, sizesFor(arch))
+}
+
+func sizes(typ *types.Struct, base int64, gcSizes types.Sizes) (out []Field) {
 	n := typ.NumFields()
 	var fields []*types.Var
 	for i := 0; i < n; i++ {
@@ -148,18 +305,22 @@ func sizes(typ *types.Struct, base int64) (out []Field) {
 				End:      offsets[i] + size,
 				Size:     size,
 				Align:    gcSizes.Alignof(field.Type()),
-				Children: sizes(typ2, pos),
+				Atomic64: isAtomic64Type(field.Type()),
+				PtrData:  ptrdata(field.Type(), gcSizes),
+				Children: sizes(typ2, offsets[i], gcSizes),
 				field:    field,
 			})
 		} else {
 			out = append(out, Field{
-				Name:  field.Name(),
-				Type:  field.Type().String(),
-				Start: offsets[i],
-				End:   offsets[i] + size,
-				Size:  size,
-				Align: gcSizes.Alignof(field.Type()),
-				field: field,
+				Name:     field.Name(),
+				Type:     field.Type().String(),
+				Start:    offsets[i],
+				End:      offsets[i] + size,
+				Size:     size,
+				Align:    gcSizes.Alignof(field.Type()),
+				Atomic64: isAtomic64Type(field.Type()),
+				PtrData:  ptrdata(field.Type(), gcSizes),
+				field:    field,
 			})
 		}
 		pos += size
@@ -192,8 +353,108 @@ func HasBetterAlignment(base, head Struct) bool {
 	return base.Padding() > head.Padding()
 }
 
-// Optimize optimizes the struct for a better aligned memory layout.
+// Options configures how structs are optimized.
+type Options struct {
+	// Archs are the target architectures the layout must be good for. If
+	// empty, only the architecture of the struct is taken into account.
+	Archs []string
+	// PtrData makes the optimizer choose, among the layouts with the
+	// smallest size, the one with the smallest prefix the garbage collector
+	// has to scan.
+	PtrData bool
+	// Hot are the names of fields that must be packed in the first cache
+	// lines of the struct, in addition to the ones marked in the source.
+	Hot []string
+}
+
+func (o Options) archs(s Struct) []string {
+	if len(o.Archs) == 0 {
+		return []string{s.Arch}
+	}
+	return o.Archs
+}
+
+// Optimize optimizes the struct for a better aligned memory layout in its
+// own architecture.
 func Optimize(s Struct) Struct {
+	return OptimizeWith(s, Options{})
+}
+
+// OptimizeWith optimizes the struct for a better aligned memory layout
+// according to the given options. When several architectures are given,
+// the field order with the smallest total size across all of them is
+// chosen. The result is laid out for the architecture of s.
+//
+// Fields accessed with 64-bit atomic operations are always placed first,
+// because the first word of an allocated struct is the only one
+// guaranteed to be 64-bit aligned on 32-bit architectures. If fields
+// pinned first come before them, the gap up to the next 64-bit boundary is
+// filled with other fields, and layouts that would still misalign them in
+// any of the architectures are discarded, keeping the struct as it is if
+// there is no other one.
+//
+// Structs marked with KeepOrder are returned as they are, and pinned fields
+// keep their declaration order at the beginning or the end of the struct.
+// Hot fields are placed before the rest.
+func OptimizeWith(s Struct, opts Options) Struct {
+	if s.KeepOrder {
+		return s
+	}
+
+	s = s.withHot(opts.Hot).withNested(opts)
+
+	archs := opts.archs(s)
+
+	var candidates [][]*types.Var
+	for _, arch := range archs {
+		candidates = append(candidates, sortedVars(s.ForArch(arch), false))
+		if opts.PtrData {
+			candidates = append(candidates, sortedVars(s.ForArch(arch), true))
+		}
+	}
+
+	var best []*types.Var
+	var bestSize, bestPtrData int64 = -1, -1
+	for _, candidate := range candidates {
+		if s.misalignsAtomics(candidate, archs) {
+			continue
+		}
+
+		size := totalSize(candidate, archs)
+		var ptrData int64
+		if opts.PtrData {
+			ptrData = totalPtrData(candidate, archs)
+		}
+
+		if bestSize < 0 || size < bestSize || (size == bestSize && ptrData < bestPtrData) {
+			best, bestSize, bestPtrData = candidate, size, ptrData
+		}
+	}
+
+	if best == nil {
+		return s
+	}
+
+	s.Fields = s.layout(best, s.Arch)
+	return s
+}
+
+// misalignsAtomics reports whether the struct laid out with the given
+// fields has fields accessed with 64-bit atomic operations that are not
+// 64-bit aligned in any of the given architectures.
+func (s Struct) misalignsAtomics(vars []*types.Var, archs []string) bool {
+	for _, arch := range archs {
+		if len(MisalignedAtomics(Struct{Fields: s.layout(vars, arch)})) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedVars returns the fields of the struct sorted for a better layout
+// in the architecture of the struct. If pointersFirst is true, fields with
+// pointers are moved first whenever that does not change the size.
+func sortedVars(s Struct, pointersFirst bool) []*types.Var {
 	var fields []Field
 	for _, f := range s.Fields {
 		if !f.IsPadding {
@@ -201,22 +462,121 @@ func Optimize(s Struct) Struct {
 		}
 	}
 
-	sortFields(fields)
+	if pointersFirst {
+		sort.Stable(byPointers{byAlignSizeAndName(fields)})
+	} else {
+		sortFields(fields)
+	}
+	fillAtomicGap(fields)
+	fillHotGap(fields)
 
-	var typeFields = make([]*types.Var, len(fields))
+	var vars = make([]*types.Var, len(fields))
 	for i, f := range fields {
-		if !f.IsPadding {
-			typeFields[i] = f.field
+		vars[i] = f.field
+	}
+	return vars
+}
+
+// totalSize returns the sum of the sizes of a struct with the given fields
+// in all the given architectures.
+func totalSize(vars []*types.Var, archs []string) int64 {
+	var total int64
+	typ := types.NewStruct(vars, nil)
+	for _, arch := range archs {
+		total += sizesFor(arch).Sizeof(typ)
+	}
+	return total
+}
+
+// fillAtomicGap moves the largest fields that fit into the gap between the
+// fields pinned first and the fields accessed with 64-bit atomic
+// operations that follow them, which are expected to be sorted, so the
+// latter start at a 64-bit boundary.
+func fillAtomicGap(fields []Field) {
+	var next int
+	var offset int64
+	for next < len(fields) && (fields[next].Pin == PinnedFirst || fields[next].Size == 0) {
+		offset = alignTo(offset, fields[next].Align) + fields[next].Size
+		next++
+	}
+
+	if next == len(fields) || !fields[next].Atomic64 {
+		return
+	}
+
+	end := alignTo(offset, 8)
+	for offset < end {
+		moved := false
+		for j := next + 1; j < len(fields); j++ {
+			f := fields[j]
+			if f.Pin != NotPinned || f.Atomic64 || f.Size == 0 || alignTo(offset, f.Align)+f.Size > end {
+				continue
+			}
+
+			copy(fields[next+1:j+1], fields[next:j])
+			fields[next] = f
+			offset = alignTo(offset, f.Align) + f.Size
+			next++
+			moved = true
+			break
+		}
+
+		if !moved {
+			return
 		}
 	}
+}
+
+// fillHotGap moves the smallest cold fields into the padding between the
+// hot fields and the rest of the fields, which are expected to be sorted.
+func fillHotGap(fields []Field) {
+	var hot int
+	var offset int64
+	var hasHot bool
+	for hot < len(fields) && (fields[hot].Hot || fields[hot].Pin == PinnedFirst || fields[hot].Atomic64 || fields[hot].Size == 0) {
+		offset = alignTo(offset, fields[hot].Align) + fields[hot].Size
+		hasHot = hasHot || fields[hot].Hot
+		hot++
+	}
+
+	if !hasHot || hot == len(fields) {
+		return
+	}
+
+	for next := hot; next < len(fields); {
+		gap := alignTo(offset, fields[next].Align) - offset
+		if gap == 0 {
+			return
+		}
+
+		moved := false
+		for j := next + 1; j < len(fields); j++ {
+			f := fields[j]
+			if f.Pin != NotPinned || alignTo(offset, f.Align)+f.Size > offset+gap {
+				continue
+			}
+
+			copy(fields[next+1:j+1], fields[next:j])
+			fields[next] = f
+			offset = alignTo(offset, f.Align) + f.Size
+			next++
+			moved = true
+			break
+		}
 
-	fieldsWithPadding := Fields(types.NewStruct(typeFields, nil))
+		if !moved {
+			return
+		}
+	}
+}
 
-	return Struct{
-		Name:   s.Name,
-		Pos:    s.Pos,
-		Fields: fieldsWithPadding,
+// alignTo returns the smallest offset greater or equal than the given one
+// with the given alignment.
+func alignTo(offset, align int64) int64 {
+	if align <= 1 {
+		return offset
 	}
+	return (offset + align - 1) / align * align
 }
 
 func sortFields(fields []Field) {
@@ -233,6 +593,14 @@ type byAlignSizeAndName []Field
 func (s byAlignSizeAndName) Len() int      { return len(s) }
 func (s byAlignSizeAndName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 func (s byAlignSizeAndName) Less(i, j int) bool {
+	if s[i].Pin != s[j].Pin {
+		return s[i].Pin.rank() < s[j].Pin.rank()
+	}
+
+	if s[i].Pin != NotPinned {
+		return false
+	}
+
 	if s[i].Size == 0 && s[j].Size != 0 {
 		return true
 	}
@@ -241,6 +609,14 @@ func (s byAlignSizeAndName) Less(i, j int) bool {
 		return false
 	}
 
+	if s[i].Atomic64 != s[j].Atomic64 {
+		return s[i].Atomic64
+	}
+
+	if s[i].Hot != s[j].Hot {
+		return s[i].Hot
+	}
+
 	if s[i].Align != s[j].Align {
 		return s[i].Align > s[j].Align
 	}
@@ -1,6 +1,7 @@
 package memlayout
 
 import (
+	"go/token"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -42,7 +43,7 @@ func TestOptimize(t *testing.T) {
 	expected := Struct{
 		Name: "Foo",
 		Fields: []Field{
-			{Name: "A", Type: "string", Size: 16, Start: 0, End: 16, Align: 8},
+			{Name: "A", Type: "string", Size: 16, Start: 0, End: 16, Align: 8, PtrData: 8},
 			{Name: "C", Type: "int64", Size: 8, Start: 16, End: 24, Align: 8},
 			{Name: "E", Type: "uint16", Size: 2, Start: 24, End: 26, Align: 2},
 			{Name: "B", Type: "bool", Size: 1, Start: 26, End: 27, Align: 1},
@@ -54,6 +55,115 @@ func TestOptimize(t *testing.T) {
 	structsEqual(t, expected, optimized)
 }
 
+func TestHoles(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(unoptimized), 0755))
+
+	structs, err := StructsFromFile(path, []byte(unoptimized))
+	require.NoError(err)
+	require.Len(structs, 1)
+
+	holes := structs[0].Holes()
+	require.Len(holes, 3)
+
+	require.Equal("B", holes[0].After.Name)
+	require.Equal("C", holes[0].Next.Name)
+	require.Equal(int64(7), holes[0].Size)
+	require.Equal(token.Position{
+		Filename: path,
+		Offset:   43,
+		Line:     6,
+		Column:   2,
+	}, holes[0].After.Position)
+
+	require.Equal("D", holes[1].After.Name)
+	require.Equal("E", holes[1].Next.Name)
+	require.Equal(int64(1), holes[1].Size)
+	require.Equal(8, holes[1].After.Position.Line)
+
+	require.Equal("E", holes[2].After.Name)
+	require.Nil(holes[2].Next)
+	require.Equal(int64(4), holes[2].Size)
+	require.Equal(int64(8), structs[0].Align())
+
+	optimized := Optimize(structs[0])
+	require.Len(optimized.Holes(), 1)
+	require.Equal(8, optimized.Holes()[0].After.Position.Line)
+	require.True(HasBetterAlignment(structs[0], optimized))
+	require.False(HasBetterAlignment(optimized, structs[0]))
+}
+
+func TestForArch(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(unoptimized), 0755))
+
+	structs, err := StructsFromFile(path, []byte(unoptimized))
+	require.NoError(err)
+	require.Len(structs, 1)
+	require.Equal(DefaultArch, structs[0].Arch)
+
+	s := structs[0].ForArch("386")
+	require.Equal("386", s.Arch)
+
+	expected := Struct{
+		Name: "Foo",
+		Fields: []Field{
+			{Name: "A", Type: "string", Size: 8, Start: 0, End: 8, Align: 4, PtrData: 4},
+			{Name: "B", Type: "bool", Size: 1, Start: 8, End: 9, Align: 1},
+			{Size: 3, IsPadding: true, Start: 9, End: 12},
+			{Name: "C", Type: "int64", Size: 8, Start: 12, End: 20, Align: 4},
+			{Name: "D", Type: "bool", Size: 1, Start: 20, End: 21, Align: 1},
+			{Size: 1, IsPadding: true, Start: 21, End: 22},
+			{Name: "E", Type: "uint16", Size: 2, Start: 22, End: 24, Align: 2},
+		},
+	}
+
+	structsEqual(t, expected, s)
+	require.Equal(int64(24), s.Size())
+	require.Equal(int64(4), s.Padding())
+}
+
+func TestOptimizeWithArchs(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(unoptimized), 0755))
+
+	structs, err := StructsFromFile(path, []byte(unoptimized))
+	require.NoError(err)
+	require.Len(structs, 1)
+
+	optimized := OptimizeWith(structs[0], Options{Archs: []string{"amd64", "arm"}})
+	require.Equal(DefaultArch, optimized.Arch)
+	require.Equal(int64(32), optimized.Size())
+
+	arm := optimized.ForArch("arm")
+	require.Equal(int64(20), arm.Size())
+	require.Equal(int64(0), arm.Padding())
+}
+
 func structsEqual(t *testing.T, expected, result Struct) {
 	t.Helper()
 	require := require.New(t)
@@ -71,14 +181,15 @@ func fieldsEqual(t *testing.T, e, r Field) {
 	if len(e.Children) > 0 {
 		require.Len(t, r.Children, len(e.Children))
 		for i := range e.Children {
-			e.Children[i].field = nil
-			r.Children[i].field = nil
+			e.Children[i].field, e.Children[i].node, e.Children[i].Position = nil, nil, token.Position{}
+			r.Children[i].field, r.Children[i].node, r.Children[i].Position = nil, nil, token.Position{}
 			fieldsEqual(t, e.Children[i], r.Children[i])
 		}
 	}
 
-	e.field = nil
-	r.field = nil
+	// Positions depend on the temporary file and are tested apart.
+	e.field, e.node, e.Position = nil, nil, token.Position{}
+	r.field, r.node, r.Position = nil, nil, token.Position{}
 
 	require.Equal(t, e, r)
 }
@@ -0,0 +1,237 @@
+package memlayout
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"strings"
+)
+
+// probeFile is the name of the file added to a package to verify the
+// layout of its structs with the compiler.
+const probeFile = "zz_memlayout_probe.go"
+
+// probeGOOS are the operating systems used to compile the probes for the
+// architectures not supported by every operating system.
+var probeGOOS = map[string]string{"wasm": "js"}
+
+// Mismatch is a difference between the layout of a struct computed by
+// memlayout and the one computed by the compiler.
+type Mismatch struct {
+	Struct string
+	Arch   string
+	// What is the measure that differs, such as "offset of B".
+	What     string
+	Model    int64
+	Compiler int64
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf(
+		"%s on %s: %s is %d, but the compiler says %d",
+		m.Struct, m.Arch, m.What, m.Model, m.Compiler,
+	)
+}
+
+// probe is a constant expression whose value computed by the compiler must
+// be the one of the model.
+type probe struct {
+	name  string
+	what  string
+	expr  string
+	model int64
+}
+
+// Verify compiles the package of the file with the given content for every
+// given architecture and compares the layout of the structs in the file
+// computed by the compiler with the one computed by memlayout, returning
+// the differences. The compiler reports the layout through the constants
+// of a generated file with unsafe.Offsetof, unsafe.Sizeof and
+// unsafe.Alignof expressions.
+//
+// Only the structs that can be referred to from the package scope are
+// verified, so anonymous and local structs, and instantiations of generic
+// structs with types of other packages as arguments are skipped.
+func Verify(filename string, content []byte, archs []string) ([]Mismatch, error) {
+	return NewSession(0).Verify(filename, content, archs)
+}
+
+// Verify compares the layout of the structs in the file with the given
+// content with the one of the compiler like Verify, loading the package of
+// the file with the session.
+func (s *Session) Verify(filename string, content []byte, archs []string) ([]Mismatch, error) {
+	filename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	structs, err := s.Structs(filename, content, Build{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := parser.ParseFile(token.NewFileSet(), filename, content, parser.PackageClauseOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Mismatch
+	for _, arch := range archs {
+		var probes []probe
+		var decls []string
+		for _, s := range structs {
+			if s.local || (s.Generic != "" && strings.Contains(s.Name, ".")) {
+				continue
+			}
+
+			s = s.ForArch(arch)
+			v := fmt.Sprintf("memlayoutProbe%d", len(decls))
+			decls = append(decls, fmt.Sprintf("%s %s", v, s.Name))
+			probes = append(probes,
+				probe{s.Name, "size", "unsafe.Sizeof(" + v + ")", s.Size()},
+				probe{s.Name, "alignment", "unsafe.Alignof(" + v + ")", s.Align()},
+			)
+			probes = append(probes, fieldProbes(s, s.Fields, v, "", "")...)
+		}
+
+		if len(probes) == 0 {
+			continue
+		}
+
+		build := Build{GOOS: probeGOOS[arch], GOARCH: arch}
+		values, err := compileProbes(filename, content, f.Name.Name, decls, probes, build)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, p := range probes {
+			if values[i] != p.model {
+				result = append(result, Mismatch{
+					Struct:   p.name,
+					Arch:     arch,
+					What:     p.what,
+					Model:    p.model,
+					Compiler: values[i],
+				})
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// fieldProbes returns the probes of the offset, size and alignment of the
+// given fields of the struct and their nested fields, selected from the
+// given expression. The offset of nested fields is relative to their
+// parent, so base is the offset of the parent.
+func fieldProbes(s Struct, fields []Field, sel, path, base string) []probe {
+	var last = -1
+	for i, f := range fields {
+		if !f.IsPadding {
+			last = i
+		}
+	}
+
+	var result []probe
+	for i, f := range fields {
+		if f.IsPadding || f.field == nil || f.Name == "_" {
+			continue
+		}
+
+		// Unexported fields of types of other packages cannot be selected.
+		if !ast.IsExported(f.Name) && path != "" && f.field.Pkg() != s.Fields[0].field.Pkg() {
+			continue
+		}
+
+		x := sel + "." + f.Name
+		offset := "unsafe.Offsetof(" + x + ")"
+		if base != "" {
+			offset = base + " + " + offset
+		}
+
+		// A zero-size field at the end of a struct is reported with the
+		// padding the compiler adds after it to avoid pointers past the end
+		// of the struct.
+		size := f.Size
+		if i == last && sizesFor(s.Arch).Sizeof(f.field.Type()) == 0 {
+			size = 0
+		}
+
+		name := path + f.Name
+		result = append(result,
+			probe{s.Name, "offset of " + name, offset, f.Start},
+			probe{s.Name, "size of " + name, "unsafe.Sizeof(" + x + ")", size},
+			probe{s.Name, "alignment of " + name, "unsafe.Alignof(" + x + ")", f.Align},
+		)
+		result = append(result, fieldProbes(s, f.Children, x, name+".", offset)...)
+	}
+	return result
+}
+
+// compileProbes compiles the package of the file with the given content
+// and a probe file with the given variable declarations and probes for the
+// given build configuration, and returns the values of the probes.
+func compileProbes(
+	filename string,
+	content []byte,
+	pkgName string,
+	decls []string,
+	probes []probe,
+	build Build,
+) ([]int64, error) {
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by memlayout. DO NOT EDIT.\n\n")
+	buf.WriteString("package " + pkgName + "\n\n")
+	buf.WriteString("import \"unsafe\"\n\n")
+	for _, d := range decls {
+		buf.WriteString("var " + d + "\n")
+	}
+	for i, p := range probes {
+		buf.WriteString(fmt.Sprintf("\nconst MemlayoutProbe%d = %s\n", i, p.expr))
+	}
+
+	dir := filepath.Dir(filename)
+	listed, err := goList(dir, build, map[string][]byte{
+		filename:                      content,
+		filepath.Join(dir, probeFile): buf.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	target := listed[len(listed)-1]
+	if target.Export == "" {
+		var msg = "no export data"
+		if target.Error != nil {
+			msg = target.Error.Err
+		}
+		return nil, fmt.Errorf("unable to compile probe of %s for %s: %s", dir, build, msg)
+	}
+
+	pkg, err := exportImporter(token.NewFileSet(), listed).Import(target.ImportPath)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]int64, len(probes))
+	for i := range probes {
+		name := fmt.Sprintf("MemlayoutProbe%d", i)
+		c, ok := pkg.Scope().Lookup(name).(*types.Const)
+		if !ok {
+			return nil, fmt.Errorf("probe %s not found in the export data of %s", name, target.ImportPath)
+		}
+
+		v, ok := constant.Int64Val(c.Val())
+		if !ok {
+			return nil, fmt.Errorf("probe %s is not an integer: %s", name, c.Val())
+		}
+		values[i] = v
+	}
+
+	return values, nil
+}
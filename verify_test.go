@@ -0,0 +1,75 @@
+package memlayout
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const verifySource = `
+package foo
+
+import "sync"
+
+type Foo struct {
+	A  string
+	B  bool
+	mu sync.Mutex
+	C  struct {
+		D bool
+		E int64
+	}
+	F [3]uint16
+	G struct{}
+}
+
+type Pair[K, V any] struct {
+	Key K
+	Val V
+}
+
+var p Pair[int8, complex128]
+
+func local() {
+	var x struct {
+		A bool
+		B int64
+	}
+	_ = x
+}
+`
+
+func TestVerify(t *testing.T) {
+	require := require.New(t)
+
+	tmp, err := ioutil.TempDir(os.TempDir(), "tmp-memlayout")
+	require.NoError(err)
+	defer func() {
+		require.NoError(os.RemoveAll(tmp))
+	}()
+
+	path := filepath.Join(tmp, "test.go")
+	require.NoError(ioutil.WriteFile(path, []byte(verifySource), 0755))
+
+	mismatches, err := Verify(path, []byte(verifySource), DefaultArchs)
+	require.NoError(err)
+	require.Len(mismatches, 0)
+
+	_, err = os.Stat(filepath.Join(tmp, probeFile))
+	require.True(os.IsNotExist(err))
+
+	probes := []probe{{expr: "unsafe.Sizeof(uintptr(0))"}, {expr: "unsafe.Alignof(memlayoutProbe0.C.E)"}}
+	for arch, expected := range map[string][]int64{"amd64": {8, 8}, "386": {4, 4}, "wasm": {8, 8}} {
+		values, err := compileProbes(path, []byte(verifySource), "foo", []string{"memlayoutProbe0 Foo"}, probes, Build{GOOS: probeGOOS[arch], GOARCH: arch})
+		require.NoError(err)
+		require.Equal(expected, values, arch)
+	}
+
+	require.Equal(
+		"Foo on 386: offset of C.E is 12, but the compiler says 16",
+		Mismatch{Struct: "Foo", Arch: "386", What: "offset of C.E", Model: 12, Compiler: 16}.String(),
+	)
+}